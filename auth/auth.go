@@ -0,0 +1,136 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+// Package auth checks HTTP Basic Auth credentials against a list of users,
+// each of which has a role.
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// What a user is allowed to do. Each role can do everything the roles before
+// it can.
+type Role int
+
+const (
+	NoRole    Role = iota
+	ReadRole       // View devices, and ask for more time.
+	WriteRole      // Give and take away Internet time.
+	AdminRole      // Add devices and profiles, and use the admin console.
+)
+
+var roleNames = []string{"none", "read", "write", "admin"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) (err error) {
+	name := strings.ToLower(string(text))
+	for i, roleName := range roleNames {
+		if name == roleName {
+			*r = Role(i)
+			return
+		}
+	}
+	err = fmt.Errorf("Unknown role %q", string(text))
+	return
+}
+
+type User struct {
+	Name         string
+	PasswordHash string // A bcrypt hash, as made by HashPassword.
+	Role         Role
+}
+
+// Returns the bcrypt hash of the password, for use in a User.
+func HashPassword(password string) (hash string, err error) {
+	data, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash = string(data)
+	return
+}
+
+type Authenticator struct {
+	users     map[string]User
+	anonymous Role
+	// Compared against when the user is unknown, so that unknown users take
+	// as long to reject as wrong passwords.
+	dummyHash []byte
+}
+
+// Returns an Authenticator for the users. Requests without credentials get
+// the anonymous role.
+func NewAuthenticator(users []User, anonymous Role) (a *Authenticator, err error) {
+	a = &Authenticator{make(map[string]User), anonymous, nil}
+	for _, u := range users {
+		if u.Name == "" {
+			err = fmt.Errorf("User without a name")
+			return
+		}
+		if _, ok := a.users[u.Name]; ok {
+			err = fmt.Errorf("User %q is listed twice", u.Name)
+			return
+		}
+		_, err = bcrypt.Cost([]byte(u.PasswordHash))
+		if err != nil {
+			err = fmt.Errorf("User %q: PasswordHash is not a bcrypt hash: %v", u.Name, err)
+			return
+		}
+		a.users[u.Name] = u
+		a.dummyHash = []byte(u.PasswordHash)
+	}
+	return
+}
+
+// Returns the role of the request's user. ok is false if the request has
+// credentials that are wrong.
+func (a *Authenticator) RoleOf(r *http.Request) (role Role, ok bool) {
+	name, password, hasAuth := r.BasicAuth()
+	if !hasAuth {
+		return a.anonymous, true
+	}
+	user, known := a.users[name]
+	hash := a.dummyHash
+	if known {
+		hash = []byte(user.PasswordHash)
+	}
+	if hash == nil || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !known {
+		return NoRole, false
+	}
+	return user.Role, true
+}
+
+// Returns a handler that only calls handler for users with at least the
+// given role.
+func (a *Authenticator) Require(role Role, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userRole, ok := a.RoleOf(r)
+		if !ok {
+			log.Printf("Bad credentials from %s for %s", r.RemoteAddr, r.URL.Path)
+		}
+		_, _, hasAuth := r.BasicAuth()
+		if !ok || (userRole < role && !hasAuth) {
+			// Ask the browser to log in.
+			w.Header().Set("WWW-Authenticate", `Basic realm="Seattle Snowman"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if userRole < role {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
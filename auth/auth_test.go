@@ -0,0 +1,106 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashHelper(t *testing.T, password string) string {
+	// The minimum cost keeps the test fast.
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword() = %v", err)
+	}
+	return string(hash)
+}
+
+// Require test case
+type rtc struct {
+	user     string // Empty for no credentials.
+	password string
+	role     Role
+	expected int // HTTP status
+}
+
+var requireTestCases = []rtc{
+	rtc{"", "", ReadRole, http.StatusOK},
+	rtc{"", "", WriteRole, http.StatusUnauthorized},
+	rtc{"mom", "secret", AdminRole, http.StatusOK},
+	rtc{"mom", "wrong", ReadRole, http.StatusUnauthorized},
+	rtc{"kid", "kidpass", ReadRole, http.StatusOK},
+	rtc{"kid", "kidpass", WriteRole, http.StatusForbidden},
+	rtc{"sitter", "sitterpass", WriteRole, http.StatusOK},
+	rtc{"sitter", "sitterpass", AdminRole, http.StatusForbidden},
+	rtc{"stranger", "secret", ReadRole, http.StatusUnauthorized},
+}
+
+func TestRequire(t *testing.T) {
+	users := []User{
+		User{"mom", hashHelper(t, "secret"), AdminRole},
+		User{"kid", hashHelper(t, "kidpass"), ReadRole},
+		User{"sitter", hashHelper(t, "sitterpass"), WriteRole},
+	}
+	a, err := NewAuthenticator(users, ReadRole)
+	if err != nil {
+		t.Fatalf("NewAuthenticator() = %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for i, tc := range requireTestCases {
+		r := httptest.NewRequest("GET", "/devices.html", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		w := httptest.NewRecorder()
+		a.Require(tc.role, ok).ServeHTTP(w, r)
+		if w.Code != tc.expected {
+			t.Errorf("case %d: %s requiring %v = %d, expected %d", i, tc.user, tc.role, w.Code, tc.expected)
+		}
+		if (w.Code == http.StatusUnauthorized) != (w.Header().Get("WWW-Authenticate") != "") {
+			t.Errorf("case %d: WWW-Authenticate = %q", i, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestNewAuthenticatorErrors(t *testing.T) {
+	hash := hashHelper(t, "secret")
+	bad := [][]User{
+		[]User{User{"mom", "secret", AdminRole}},
+		[]User{User{"", hash, AdminRole}},
+		[]User{User{"mom", hash, AdminRole}, User{"mom", hash, ReadRole}},
+	}
+	for i, users := range bad {
+		_, err := NewAuthenticator(users, NoRole)
+		if err == nil {
+			t.Errorf("case %d: NewAuthenticator(%v) succeeded", i, users)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")) != nil {
+		t.Errorf("HashPassword() = %q, %v", hash, err)
+	}
+}
+
+func TestRoleJSON(t *testing.T) {
+	var u User
+	err := json.Unmarshal([]byte(`{"name": "kid", "role": "Write"}`), &u)
+	if err != nil || u.Role != WriteRole {
+		t.Errorf("json.Unmarshal() = %v, %v", u, err)
+	}
+	err = json.Unmarshal([]byte(`{"name": "kid", "role": "superuser"}`), &u)
+	if err == nil {
+		t.Errorf("json.Unmarshal() of an unknown role succeeded")
+	}
+	js, err := json.Marshal(AdminRole)
+	if err != nil || string(js) != `"admin"` {
+		t.Errorf("json.Marshal(AdminRole) = %s, %v", js, err)
+	}
+}
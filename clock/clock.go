@@ -0,0 +1,44 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+// Package clock is the source of time for Seattle Snowman, so that tests can
+// control it. See the clocktest package for a fake clock.
+package clock
+
+import (
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	// Returns a timer that fires once, after d.
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	// Returns false if the timer had already fired or been stopped.
+	Stop() bool
+}
+
+// Returns a clock that tells the real time.
+func New() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+// Package clocktest provides a fake clock for tests.
+package clocktest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/clock"
+)
+
+// A clock that only moves when Advance or Set is called.
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *FakeClock
+	when    time.Time
+	c       chan time.Time
+	stopped bool
+	fired   bool
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{c, c.now.Add(d), make(chan time.Time, 1), false, false}
+	c.timers = append(c.timers, t)
+	c.fire()
+	return t
+}
+
+// Moves the clock forward by d, firing the timers that are due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// Sets the clock to now, firing the timers that are due.
+func (c *FakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+	c.fire()
+}
+
+// Fires the timers that are due. Called with the mutex held.
+func (c *FakeClock) fire() {
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.stopped {
+			continue
+		}
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.fired = true
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// Returns when the timers that have not fired or been stopped will fire.
+func (c *FakeClock) ActiveTimers() (times []time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, t := range c.timers {
+		if !t.stopped {
+			times = append(times, t.when)
+		}
+	}
+	return
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := !t.stopped && !t.fired
+	t.stopped = true
+	return wasActive
+}
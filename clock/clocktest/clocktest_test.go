@@ -0,0 +1,54 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2015, 3, 3, 19, 30, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	early := c.NewTimer(time.Hour)
+	late := c.NewTimer(2 * time.Hour)
+	stopped := c.NewTimer(time.Hour)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Errorf("Stop() should only succeed once")
+	}
+	c.Advance(time.Hour)
+	if !c.Now().Equal(start.Add(time.Hour)) {
+		t.Errorf("Now() = %v after Advance", c.Now())
+	}
+	select {
+	case <-early.C():
+	default:
+		t.Errorf("Timer due at %v did not fire", start.Add(time.Hour))
+	}
+	if early.Stop() {
+		t.Errorf("Stop() of a timer that had fired succeeded")
+	}
+	select {
+	case <-late.C():
+		t.Errorf("Timer fired early")
+	case <-stopped.C():
+		t.Errorf("Stopped timer fired")
+	default:
+	}
+	if timers := c.ActiveTimers(); len(timers) != 1 || !timers[0].Equal(start.Add(2*time.Hour)) {
+		t.Errorf("ActiveTimers() = %v", timers)
+	}
+	c.Set(start.Add(3 * time.Hour))
+	select {
+	case <-late.C():
+	default:
+		t.Errorf("Timer did not fire after Set")
+	}
+	// Timers that are already due fire at once.
+	now := c.NewTimer(-time.Minute)
+	select {
+	case <-now.C():
+	default:
+		t.Errorf("Timer in the past did not fire")
+	}
+}
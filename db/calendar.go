@@ -2,7 +2,13 @@
 
 package db
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
 type TimePeriod struct {
 	Start time.Time
@@ -23,6 +29,11 @@ func (tp TimeOfDayPeriod) Equal(o TimeOfDayPeriod) bool {
 	return TimePeriod(tp).Equal(TimePeriod(o))
 }
 
+// Hours that end at or before the time they start end on the following day.
+func (tp TimeOfDayPeriod) crossesMidnight() bool {
+	return !tp.End.After(tp.Start)
+}
+
 func (d TimeOfDayPeriod) String() string {
 	return d.Start.Format(time.Kitchen) + " - " + d.End.Format(time.Kitchen)
 }
@@ -41,13 +52,38 @@ func (d DatePeriod) String() string {
 
 type Calendar interface {
 	RuleAt(t time.Time) (isOn bool, period TimePeriod)
+	// Returns the quota day and quota week that include t.
+	QuotaPeriodsAt(t time.Time) (day TimePeriod, week TimePeriod)
+}
+
+// Named calendars. The calendar named "" is the default calendar.
+type Calendars map[string]Calendar
+
+// Returns the named calendar, or the default calendar if there is no calendar
+// with that name.
+func (c Calendars) For(name string) Calendar {
+	if calendar, ok := c[name]; ok {
+		return calendar
+	}
+	return c[""]
+}
+
+// Returns an error if there is no calendar with the given name.
+func (c Calendars) Check(name string) (err error) {
+	if _, ok := c[name]; !ok {
+		err = fmt.Errorf("Unknown calendar %q", name)
+	}
+	return
 }
 
 type timeClock struct {
 	location       *time.Location
-	schoolDayHours TimeOfDayPeriod // Monday hours
-	vacationHours  TimeOfDayPeriod // Saturday hours
+	schoolDayHours []TimeOfDayPeriod // Monday hours
+	vacationHours  []TimeOfDayPeriod // Saturday hours
+	weekdayHours   map[time.Weekday][]TimeOfDayPeriod
 	holidays       []DatePeriod
+	quotaResetTime time.Time    // Time of day when quota days start.
+	quotaResetDay  time.Weekday // Day of the week when quota weeks start.
 }
 
 // This configuration information should be in a database someday, but for now
@@ -58,6 +94,23 @@ type TimeOfDayPeriodConfig struct {
 	EndTime   string
 }
 
+// The access windows of a day, in order. In JSON a single window may be
+// written on its own, without the enclosing list.
+type TimeOfDayPeriodsConfig []TimeOfDayPeriodConfig
+
+func (c *TimeOfDayPeriodsConfig) UnmarshalJSON(data []byte) (err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var list []TimeOfDayPeriodConfig
+		err = json.Unmarshal(data, &list)
+		*c = list
+		return
+	}
+	var single TimeOfDayPeriodConfig
+	err = json.Unmarshal(data, &single)
+	*c = TimeOfDayPeriodsConfig{single}
+	return
+}
+
 type DateRangeConfig struct {
 	StartDay string
 	// This is inclusive
@@ -66,9 +119,17 @@ type DateRangeConfig struct {
 
 type CalendarConfig struct {
 	Location       string
-	SchoolDayHours TimeOfDayPeriodConfig
-	VacationHours  TimeOfDayPeriodConfig
-	Holidays       []DateRangeConfig
+	SchoolDayHours TimeOfDayPeriodsConfig
+	VacationHours  TimeOfDayPeriodsConfig
+	// Optional hours for particular days of the week, keyed by day name
+	// ("Monday"). On days that are not holidays they replace the school day
+	// and vacation hours.
+	WeekdayHours map[string]TimeOfDayPeriodsConfig
+	Holidays     []DateRangeConfig
+	// When daily quotas reset, as a time of day. Defaults to midnight.
+	QuotaResetTime string
+	// When weekly quotas reset, as a day of the week. Defaults to Sunday.
+	QuotaResetDay string
 }
 
 func NewCalendar(cc *CalendarConfig) (tc Calendar, err error) {
@@ -76,16 +137,41 @@ func NewCalendar(cc *CalendarConfig) (tc Calendar, err error) {
 	return
 }
 
+// Create the default calendar and the named calendars.
+func NewCalendars(defaultConfig *CalendarConfig, named map[string]CalendarConfig) (calendars Calendars, err error) {
+	calendars = make(Calendars)
+	calendars[""], err = NewCalendar(defaultConfig)
+	if err != nil {
+		return
+	}
+	for name, cc := range named {
+		if name == "" {
+			err = fmt.Errorf("Calendar names must not be empty")
+			return
+		}
+		calendars[name], err = NewCalendar(&cc)
+		if err != nil {
+			err = fmt.Errorf("Calendar %q: %v", name, err)
+			return
+		}
+	}
+	return
+}
+
 func ParseTimeClock(cc *CalendarConfig) (tc *timeClock, err error) {
 	location, err := time.LoadLocation(cc.Location)
 	if err != nil {
 		return
 	}
-	schoolDayHours, err := ParseTimeOfDayPeriod(cc.SchoolDayHours)
+	schoolDayHours, err := ParseTimeOfDayPeriods(cc.SchoolDayHours)
+	if err != nil {
+		return
+	}
+	vacationHours, err := ParseTimeOfDayPeriods(cc.VacationHours)
 	if err != nil {
 		return
 	}
-	vacationHours, err := ParseTimeOfDayPeriod(cc.VacationHours)
+	weekdayHours, err := parseWeekdayHours(cc.WeekdayHours)
 	if err != nil {
 		return
 	}
@@ -93,7 +179,22 @@ func ParseTimeClock(cc *CalendarConfig) (tc *timeClock, err error) {
 	if err != nil {
 		return
 	}
-	tc = &timeClock{location, schoolDayHours, vacationHours, holidays}
+	quotaResetTime, err := ParseTimeOfDay("12:00AM")
+	if cc.QuotaResetTime != "" {
+		quotaResetTime, err = ParseTimeOfDay(cc.QuotaResetTime)
+	}
+	if err != nil {
+		return
+	}
+	quotaResetDay := time.Sunday
+	if cc.QuotaResetDay != "" {
+		quotaResetDay, err = ParseWeekday(cc.QuotaResetDay)
+		if err != nil {
+			return
+		}
+	}
+	tc = &timeClock{location, schoolDayHours, vacationHours, weekdayHours, holidays,
+		quotaResetTime, quotaResetDay}
 	return
 }
 
@@ -113,6 +214,55 @@ func ParseTimeOfDayPeriod(todc TimeOfDayPeriodConfig) (tp TimeOfDayPeriod, err e
 	return
 }
 
+func ParseTimeOfDayPeriods(todcs TimeOfDayPeriodsConfig) (tps []TimeOfDayPeriod, err error) {
+	for _, todc := range todcs {
+		var tp TimeOfDayPeriod
+		tp, err = ParseTimeOfDayPeriod(todc)
+		if err != nil {
+			return
+		}
+		if len(tps) > 0 {
+			previous := tps[len(tps)-1]
+			if previous.crossesMidnight() {
+				err = fmt.Errorf("Only the last hours of a day may cross midnight: %v", previous)
+				return
+			}
+			if tp.Start.Before(previous.End) {
+				err = fmt.Errorf("Hours %v start before the previous hours %v end", tp, previous)
+				return
+			}
+		}
+		tps = append(tps, tp)
+	}
+	return
+}
+
+func ParseWeekday(name string) (weekday time.Weekday, err error) {
+	for weekday = time.Sunday; weekday <= time.Saturday; weekday++ {
+		if strings.EqualFold(name, weekday.String()) {
+			return
+		}
+	}
+	err = fmt.Errorf("Unknown day of the week %q", name)
+	return
+}
+
+func parseWeekdayHours(whc map[string]TimeOfDayPeriodsConfig) (weekdayHours map[time.Weekday][]TimeOfDayPeriod, err error) {
+	weekdayHours = make(map[time.Weekday][]TimeOfDayPeriod)
+	for name, todcs := range whc {
+		var weekday time.Weekday
+		weekday, err = ParseWeekday(name)
+		if err != nil {
+			return
+		}
+		weekdayHours[weekday], err = ParseTimeOfDayPeriods(todcs)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 func beginningOfPreviousDay(t time.Time) time.Time {
 	year, month, day := t.Date()
 	return time.Date(year, month, day-1, 0, 0, 0, 0, t.Location())
@@ -153,23 +303,75 @@ func ParseDateRange(dr DateRangeConfig, location *time.Location) (dp DatePeriod,
 	return
 }
 
+// How far RuleAt looks for the previous and next access windows.
+const ruleSearchDays = 14
+
 func (tc *timeClock) RuleAt(t time.Time) (isOn bool, period TimePeriod) {
-	activeTime := tc.activeTimeFor(t)
-	if activeTime.Includes(t) {
-		isOn, period = true, activeTime
-		return
+	t = t.In(tc.location)
+	windows := tc.windowsBetween(addDays(t, -ruleSearchDays), addDays(t, ruleSearchDays))
+	for _, w := range windows {
+		if w.Includes(t) {
+			isOn, period = true, w
+			return
+		}
+		if !w.End.After(t) {
+			period.Start = w.End
+		} else {
+			period.End = w.Start
+			break
+		}
+	}
+	return
+}
+
+func addDays(t time.Time, days int) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day+days, 0, 0, 0, 0, t.Location())
+}
+
+// Returns the access windows of the days from start through end, in order.
+// Windows that touch or overlap, for example because a window crosses
+// midnight into the next day's first window, are merged.
+func (tc *timeClock) windowsBetween(start time.Time, end time.Time) (windows []TimePeriod) {
+	for day := start; !day.After(end); day = beginningOfNextDay(day) {
+		for _, w := range tc.windowsFor(day) {
+			if n := len(windows); n > 0 && !w.Start.After(windows[n-1].End) {
+				windows[n-1].End = maxTime(windows[n-1].End, w.End)
+				continue
+			}
+			windows = append(windows, w)
+		}
 	}
-	if t.Before(activeTime.Start) {
-		prevDayEnd := tc.endTimeFor(beginningOfPreviousDay(t))
-		return false, TimePeriod{prevDayEnd, activeTime.Start}
-	} else {
-		nextDayStart := tc.startTimeFor(beginningOfNextDay(t))
-		return false, TimePeriod{activeTime.End, nextDayStart}
+	return
+}
+
+// Returns the access windows of the day of t, in order.
+func (tc *timeClock) windowsFor(t time.Time) (windows []TimePeriod) {
+	for _, tod := range tc.timesOfDayFor(t) {
+		endDate := t
+		if tod.crossesMidnight() {
+			endDate = beginningOfNextDay(t)
+		}
+		windows = append(windows, TimePeriod{
+			tc.mergeDateAndTimeOfDay(t, tod.Start),
+			tc.mergeDateAndTimeOfDay(endDate, tod.End)})
 	}
+	return
 }
 
-func (tc *timeClock) activeTimeFor(t time.Time) TimePeriod {
-	return TimePeriod{tc.startTimeFor(t), tc.endTimeFor(t)}
+func (tc *timeClock) QuotaPeriodsAt(t time.Time) (day TimePeriod, week TimePeriod) {
+	t = t.In(tc.location)
+	date := t
+	if tc.mergeDateAndTimeOfDay(date, tc.quotaResetTime).After(t) {
+		date = beginningOfPreviousDay(t)
+	}
+	day = TimePeriod{tc.mergeDateAndTimeOfDay(date, tc.quotaResetTime),
+		tc.mergeDateAndTimeOfDay(beginningOfNextDay(date), tc.quotaResetTime)}
+	daysSinceReset := (int(date.Weekday()) - int(tc.quotaResetDay) + 7) % 7
+	weekStart := addDays(date, -daysSinceReset)
+	week = TimePeriod{tc.mergeDateAndTimeOfDay(weekStart, tc.quotaResetTime),
+		tc.mergeDateAndTimeOfDay(addDays(weekStart, 7), tc.quotaResetTime)}
+	return
 }
 
 func (tc *timeClock) isSchoolDay(t time.Time) bool {
@@ -184,20 +386,30 @@ func (tc *timeClock) isSchoolNight(t time.Time) bool {
 	return tc.isSchoolDay(beginningOfNextDay(t))
 }
 
-func (tc *timeClock) startTimeOfDayFor(t time.Time) time.Time {
-	return tc.activeHoursForDayType(tc.isSchoolDay(t)).Start
-}
-
-func (tc *timeClock) endTimeOfDayFor(t time.Time) time.Time {
-	return tc.activeHoursForDayType(tc.isSchoolNight(t)).End
-}
-
-func (tc *timeClock) startTimeFor(t time.Time) time.Time {
-	return tc.mergeDateAndTimeOfDay(t, tc.startTimeOfDayFor(t))
+// Returns the hours for the day of the week of t, if there are any.
+// Holidays always use vacation hours.
+func (tc *timeClock) weekdayHoursFor(t time.Time) (tods []TimeOfDayPeriod, ok bool) {
+	if tc.isHoliday(t) {
+		return
+	}
+	tods, ok = tc.weekdayHours[t.Weekday()]
+	return
 }
 
-func (tc *timeClock) endTimeFor(t time.Time) time.Time {
-	return tc.mergeDateAndTimeOfDay(t, tc.endTimeOfDayFor(t))
+// Returns the access hours of the day of t. The day starts with the hours of
+// its day type, but the last hours of the day end when the hours of the
+// following night end, so that school nights end early.
+func (tc *timeClock) timesOfDayFor(t time.Time) (tods []TimeOfDayPeriod) {
+	if weekdayHours, ok := tc.weekdayHoursFor(t); ok {
+		return weekdayHours
+	}
+	dayHours := tc.activeHoursForDayType(tc.isSchoolDay(t))
+	nightHours := tc.activeHoursForDayType(tc.isSchoolNight(t))
+	tods = append(tods, dayHours...)
+	if len(tods) > 0 && len(nightHours) > 0 {
+		tods[len(tods)-1].End = nightHours[len(nightHours)-1].End
+	}
+	return
 }
 
 func (tc *timeClock) isHoliday(t time.Time) bool {
@@ -210,13 +422,11 @@ func (tc *timeClock) isHoliday(t time.Time) bool {
 	return false
 }
 
-func (tc *timeClock) activeHoursForDayType(isSchoolDay bool) (tod TimeOfDayPeriod) {
+func (tc *timeClock) activeHoursForDayType(isSchoolDay bool) (tods []TimeOfDayPeriod) {
 	if isSchoolDay {
 		return tc.schoolDayHours
-	} else {
-		return tc.vacationHours
 	}
-	return
+	return tc.vacationHours
 }
 
 func (tc *timeClock) mergeDateAndTimeOfDay(date time.Time, timeOfDay time.Time) time.Time {
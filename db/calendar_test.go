@@ -3,6 +3,8 @@
 package db
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -75,15 +77,29 @@ func TestDatePeriod(t *testing.T) {
 }
 
 var calendarConfig = &CalendarConfig{
-	"America/Los_Angeles",
-	TimeOfDayPeriodConfig{"4:00PM", "8:00PM"}, // SchoolDay
-	TimeOfDayPeriodConfig{"1:00PM", "9:00PM"}, // VacationDay
-	[]DateRangeConfig{
+	Location:       "America/Los_Angeles",
+	SchoolDayHours: TimeOfDayPeriodsConfig{{"4:00PM", "8:00PM"}},
+	VacationHours:  TimeOfDayPeriodsConfig{{"1:00PM", "9:00PM"}},
+	Holidays: []DateRangeConfig{
 		DateRangeConfig{"4/6/15", "4/10/15"},
 		DateRangeConfig{"5/22/15", "5/25/15"},
 	},
 }
 
+// Like calendarConfig, but with later Fridays and earlier Sundays.
+var weekdayCalendarConfig = &CalendarConfig{
+	Location:       "America/Los_Angeles",
+	SchoolDayHours: TimeOfDayPeriodsConfig{{"4:00PM", "8:00PM"}},
+	VacationHours:  TimeOfDayPeriodsConfig{{"1:00PM", "9:00PM"}},
+	WeekdayHours: map[string]TimeOfDayPeriodsConfig{
+		"Friday": TimeOfDayPeriodsConfig{{"4:00PM", "10:00PM"}},
+		"sunday": TimeOfDayPeriodsConfig{{"1:00PM", "7:00PM"}},
+	},
+	Holidays: []DateRangeConfig{
+		DateRangeConfig{"4/6/15", "4/10/15"},
+	},
+}
+
 func TestCalendar(t *testing.T) {
 	calendar, err := NewCalendar(calendarConfig)
 	if err != nil {
@@ -186,7 +202,11 @@ var activeTimeTestCases = []attc{
 }
 
 func testActiveTime(t *testing.T, tc *timeClock) {
-	for i, attc := range activeTimeTestCases {
+	testActiveTimeCases(t, tc, activeTimeTestCases)
+}
+
+func testActiveTimeCases(t *testing.T, tc *timeClock, testCases []attc) {
+	for i, attc := range testCases {
 		date, err := ParseDate(attc.date, tc.location)
 		if err != nil {
 			t.Errorf("case %d. ParseDate(%s,%s) = %v", i, attc.date, tc.location, err)
@@ -230,6 +250,176 @@ func testActiveTime(t *testing.T, tc *timeClock) {
 	}
 }
 
+var weekdayActiveTimeTestCases = []attc{
+	// Sunday, from the weekday table
+	attc{"03/01/15", "12:00PM", false, "9:00PM", "1:00PM"},
+	attc{"03/01/15", "1:00PM", true, "1:00PM", "7:00PM"},
+	attc{"03/01/15", "7:00PM", false, "7:00PM", "4:00PM"},
+	// Thursday, a school day
+	attc{"03/05/15", "9:00PM", false, "8:00PM", "4:00PM"},
+	// Friday, from the weekday table
+	attc{"03/06/15", "5:00PM", true, "4:00PM", "10:00PM"},
+	attc{"03/06/15", "10:00PM", false, "10:00PM", "1:00PM"},
+	// Friday and holiday, vacation hours
+	attc{"04/10/15", "12:00PM", false, "9:00PM", "1:00PM"},
+	attc{"04/10/15", "2:00PM", true, "1:00PM", "9:00PM"},
+}
+
+func TestWeekdayCalendar(t *testing.T) {
+	calendar, err := NewCalendar(weekdayCalendarConfig)
+	if err != nil {
+		t.Errorf("NewCalendar(%v) = %v", weekdayCalendarConfig, err)
+		return
+	}
+	testActiveTimeCases(t, calendar.(*timeClock), weekdayActiveTimeTestCases)
+}
+
+func TestBadWeekdayCalendar(t *testing.T) {
+	cc := *weekdayCalendarConfig
+	cc.WeekdayHours = map[string]TimeOfDayPeriodsConfig{
+		"Caturday": TimeOfDayPeriodsConfig{{"1:00PM", "9:00PM"}},
+	}
+	_, err := NewCalendar(&cc)
+	if err == nil {
+		t.Errorf("NewCalendar(%v) succeeded", cc)
+	}
+}
+
+// Before and after school, with a gap in the middle of the day.
+var multipleWindowCalendarConfig = &CalendarConfig{
+	Location:       "America/Los_Angeles",
+	SchoolDayHours: TimeOfDayPeriodsConfig{{"7:00AM", "8:00AM"}, {"4:00PM", "8:00PM"}},
+	VacationHours:  TimeOfDayPeriodsConfig{{"9:00AM", "12:00PM"}, {"1:00PM", "9:00PM"}},
+}
+
+var multipleWindowActiveTimeTestCases = []attc{
+	// Sunday vacation Day, School Night
+	attc{"03/01/15", "8:00AM", false, "9:00PM", "9:00AM"},
+	attc{"03/01/15", "9:00AM", true, "9:00AM", "12:00PM"},
+	attc{"03/01/15", "12:30PM", false, "12:00PM", "1:00PM"},
+	attc{"03/01/15", "1:00PM", true, "1:00PM", "8:00PM"},
+	attc{"03/01/15", "8:00PM", false, "8:00PM", "7:00AM"},
+	// Monday
+	attc{"03/02/15", "7:30AM", true, "7:00AM", "8:00AM"},
+	attc{"03/02/15", "8:00AM", false, "8:00AM", "4:00PM"},
+	attc{"03/02/15", "4:00PM", true, "4:00PM", "8:00PM"},
+	// Fri
+	attc{"03/06/15", "4:00PM", true, "4:00PM", "9:00PM"},
+	attc{"03/06/15", "9:00PM", false, "9:00PM", "9:00AM"},
+}
+
+func TestMultipleWindowCalendar(t *testing.T) {
+	calendar, err := NewCalendar(multipleWindowCalendarConfig)
+	if err != nil {
+		t.Errorf("NewCalendar(%v) = %v", multipleWindowCalendarConfig, err)
+		return
+	}
+	testActiveTimeCases(t, calendar.(*timeClock), multipleWindowActiveTimeTestCases)
+}
+
+// Late vacation nights that end after midnight.
+var overnightCalendarConfig = &CalendarConfig{
+	Location:       "America/Los_Angeles",
+	SchoolDayHours: TimeOfDayPeriodsConfig{{"4:00PM", "8:00PM"}},
+	VacationHours:  TimeOfDayPeriodsConfig{{"6:00PM", "1:00AM"}},
+}
+
+var overnightActiveTimeTestCases = []attc{
+	// Friday, school day followed by a vacation night
+	attc{"02/27/15", "3:00PM", false, "8:00PM", "4:00PM"},
+	attc{"02/27/15", "4:00PM", true, "4:00PM", "1:00AM"},
+	attc{"02/27/15", "11:00PM", true, "4:00PM", "1:00AM"},
+	// Saturday, spill-over from Friday night
+	attc{"02/28/15", "12:00AM", true, "4:00PM", "1:00AM"},
+	attc{"02/28/15", "12:30AM", true, "4:00PM", "1:00AM"},
+	attc{"02/28/15", "1:00AM", false, "1:00AM", "6:00PM"},
+	attc{"02/28/15", "11:00PM", true, "6:00PM", "1:00AM"},
+	// Sunday, school night
+	attc{"03/01/15", "12:00AM", true, "6:00PM", "1:00AM"},
+	attc{"03/01/15", "2:00AM", false, "1:00AM", "6:00PM"},
+	attc{"03/01/15", "6:00PM", true, "6:00PM", "8:00PM"},
+	attc{"03/01/15", "9:00PM", false, "8:00PM", "4:00PM"},
+	// Monday
+	attc{"03/02/15", "12:30AM", false, "8:00PM", "4:00PM"},
+}
+
+func TestOvernightCalendar(t *testing.T) {
+	calendar, err := NewCalendar(overnightCalendarConfig)
+	if err != nil {
+		t.Errorf("NewCalendar(%v) = %v", overnightCalendarConfig, err)
+		return
+	}
+	testActiveTimeCases(t, calendar.(*timeClock), overnightActiveTimeTestCases)
+}
+
+// A sleepover: Saturday night runs until midnight, and Sunday starts at
+// midnight, so there is no gap between them.
+var sleepoverCalendarConfig = &CalendarConfig{
+	Location:       "America/Los_Angeles",
+	SchoolDayHours: TimeOfDayPeriodsConfig{{"4:00PM", "8:00PM"}},
+	VacationHours:  TimeOfDayPeriodsConfig{{"1:00PM", "9:00PM"}},
+	WeekdayHours: map[string]TimeOfDayPeriodsConfig{
+		"Saturday": TimeOfDayPeriodsConfig{{"6:00PM", "12:00AM"}},
+		"Sunday":   TimeOfDayPeriodsConfig{{"12:00AM", "2:00AM"}, {"1:00PM", "7:00PM"}},
+	},
+}
+
+var sleepoverActiveTimeTestCases = []attc{
+	attc{"02/28/15", "11:00PM", true, "6:00PM", "2:00AM"},
+	attc{"03/01/15", "12:00AM", true, "6:00PM", "2:00AM"},
+	attc{"03/01/15", "1:59AM", true, "6:00PM", "2:00AM"},
+	attc{"03/01/15", "2:00AM", false, "2:00AM", "1:00PM"},
+}
+
+func TestSleepoverCalendar(t *testing.T) {
+	calendar, err := NewCalendar(sleepoverCalendarConfig)
+	if err != nil {
+		t.Errorf("NewCalendar(%v) = %v", sleepoverCalendarConfig, err)
+		return
+	}
+	testActiveTimeCases(t, calendar.(*timeClock), sleepoverActiveTimeTestCases)
+}
+
+func TestMidnightWindowMustBeLast(t *testing.T) {
+	todcs := TimeOfDayPeriodsConfig{{"10:00PM", "1:00AM"}, {"2:00AM", "3:00AM"}}
+	_, err := ParseTimeOfDayPeriods(todcs)
+	if err == nil {
+		t.Errorf("ParseTimeOfDayPeriods(%v) succeeded", todcs)
+	}
+}
+
+func TestOverlappingWindows(t *testing.T) {
+	todcs := TimeOfDayPeriodsConfig{{"4:00PM", "8:00PM"}, {"7:00PM", "9:00PM"}}
+	_, err := ParseTimeOfDayPeriods(todcs)
+	if err == nil {
+		t.Errorf("ParseTimeOfDayPeriods(%v) succeeded", todcs)
+	}
+}
+
+// TimeOfDayPeriodsConfig JSON test case
+type todpjtc struct {
+	json     string
+	expected TimeOfDayPeriodsConfig
+}
+
+var timeOfDayPeriodsJSONTestCases = []todpjtc{
+	todpjtc{`{"starttime": "4:00PM", "endtime": "8:00PM"}`,
+		TimeOfDayPeriodsConfig{{"4:00PM", "8:00PM"}}},
+	todpjtc{` [{"starttime": "7:00AM", "endtime": "8:00AM"}, {"starttime": "4:00PM", "endtime": "8:00PM"}]`,
+		TimeOfDayPeriodsConfig{{"7:00AM", "8:00AM"}, {"4:00PM", "8:00PM"}}},
+	todpjtc{`[]`, TimeOfDayPeriodsConfig{}},
+}
+
+func TestTimeOfDayPeriodsJSON(t *testing.T) {
+	for i, tc := range timeOfDayPeriodsJSONTestCases {
+		var c TimeOfDayPeriodsConfig
+		err := json.Unmarshal([]byte(tc.json), &c)
+		if err != nil || !reflect.DeepEqual(c, tc.expected) {
+			t.Errorf("case %d: json.Unmarshal(%s) = %v, %v, expected %v", i, tc.json, c, err, tc.expected)
+		}
+	}
+}
+
 func testTimeClock(t *testing.T, tc *timeClock) {
 	testActiveHoursForDayType(t, tc)
 	testSchoolDays(t, tc)
@@ -237,8 +427,18 @@ func testTimeClock(t *testing.T, tc *timeClock) {
 }
 
 func testActiveHoursForDayType(t *testing.T, tc *timeClock) {
-	checkEqualTimeOfDayPeriod(t, "tc.activeHoursForDayType(true)", tc.activeHoursForDayType(true), tc.schoolDayHours)
-	checkEqualTimeOfDayPeriod(t, "tc.activeHoursForDayType(false)", tc.activeHoursForDayType(false), tc.vacationHours)
+	checkEqualTimeOfDayPeriods(t, "tc.activeHoursForDayType(true)", tc.activeHoursForDayType(true), tc.schoolDayHours)
+	checkEqualTimeOfDayPeriods(t, "tc.activeHoursForDayType(false)", tc.activeHoursForDayType(false), tc.vacationHours)
+}
+
+func checkEqualTimeOfDayPeriods(t *testing.T, label string, a []TimeOfDayPeriod, b []TimeOfDayPeriod) {
+	if len(a) != len(b) {
+		t.Errorf("%s = %v (expected %v)", label, a, b)
+		return
+	}
+	for i := range a {
+		checkEqualTimeOfDayPeriod(t, label, a[i], b[i])
+	}
 }
 
 func checkEqualTimeOfDayPeriod(t *testing.T, label string, a TimeOfDayPeriod, b TimeOfDayPeriod) {
@@ -33,10 +33,29 @@ type Device struct {
 	IP          DeviceIP
 	Name        string
 	ActiveUntil time.Time
+	Calendar    string // Name of the device's calendar. Empty to use the profile's calendar.
+	Profile     string // Name of the profile that owns the device. Empty if none.
 }
 
 func NewDevice(ip string, name string) Device {
-	return Device{ParseDeviceIP(ip), name, time.Time{}}
+	return Device{ParseDeviceIP(ip), name, time.Time{}, "", ""}
+}
+
+// A profile groups the devices of one person. Time granted to a profile
+// applies to all of its devices.
+type Profile struct {
+	Name        string
+	ActiveUntil time.Time
+	Calendar    string // Name of the calendar of the profile's devices. Empty for the default calendar.
+	// A profile with a quota is only unblocked during quota sessions, which
+	// spend its quota. Zero means no quota.
+	DailyQuota  Duration
+	WeeklyQuota Duration
+	QuotaUsage  QuotaUsage
+}
+
+func NewProfile(name string) Profile {
+	return Profile{Name: name}
 }
 
 // Helper func for modifying activeUntil
@@ -60,10 +79,35 @@ type DB interface {
 	Find(ip DeviceIP) (device Device, found bool, err error)
 	All() (devices []Device, err error)
 	SetActiveUntil(ip DeviceIP, activeUntil time.Time) (err error)
+	// Copies the fields that come from the configuration, Name, Calendar and
+	// Profile, onto the device with d's IP. Its ActiveUntil is kept.
+	SetDeviceConfig(d Device) (err error)
 
 	// Modify the active time by the delta, taking into account the baseTime.
 	// Typically the baseTIme is "now".
 	// activeTime := max(max(activeTime, baseTime) + delta, baseTime)
 	ModifyActiveUntil(ip DeviceIP, delta time.Duration, baseTime time.Time) (err error)
+
+	// Fails if there is already a profile with p's name.
+	AddProfile(p Profile) (err error)
+	RemoveProfile(name string) (err error)
+	FindProfile(name string) (profile Profile, found bool, err error)
+	AllProfiles() (profiles []Profile, err error)
+	SetProfileActiveUntil(name string, activeUntil time.Time) (err error)
+	// Like ModifyActiveUntil, for a profile.
+	ModifyProfileActiveUntil(name string, delta time.Duration, baseTime time.Time) (err error)
+	SetProfileQuotaUsage(name string, usage QuotaUsage) (err error)
+	// Copies the fields that come from the configuration, Calendar,
+	// DailyQuota and WeeklyQuota, onto the profile with p's name. Its
+	// ActiveUntil and QuotaUsage are kept.
+	SetProfileConfig(p Profile) (err error)
+
+	// Adds the request, giving it a new ID.
+	AddTimeRequest(r TimeRequest) (id int, err error)
+	RemoveTimeRequest(id int) (err error)
+	FindTimeRequest(id int) (request TimeRequest, found bool, err error)
+	AllTimeRequests() (requests []TimeRequest, err error)
+	SetTimeRequestStatus(id int, status TimeRequestStatus, answered time.Time) (err error)
+
 	Close() (err error)
 }
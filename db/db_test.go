@@ -25,7 +25,7 @@ func exerciseDB(t *testing.T, db DB) {
 		return
 	}
 	martianIP := ParseDeviceIP("10.10.10.10")
-	err = db.Add(Device{martianIP, "martian", time.Time{}})
+	err = db.Add(Device{IP: martianIP, Name: "martian"})
 	if err != nil {
 		t.Errorf("db.Add(\"martian\") = %v", err)
 		return
@@ -63,6 +63,100 @@ func exerciseDB(t *testing.T, db DB) {
 		t.Errorf("after remove db.Find(\"martian\") = %v, %v, %v", device, found, err)
 		return
 	}
+
+	exerciseProfiles(t, db)
+	exerciseTimeRequests(t, db)
+}
+
+func exerciseProfiles(t *testing.T, db DB) {
+	for _, name := range []string{"Alice", "Bob"} {
+		err := db.AddProfile(NewProfile(name))
+		if err != nil {
+			t.Errorf("db.AddProfile(%q) = %v", name, err)
+			return
+		}
+	}
+	err := db.AddProfile(NewProfile("Alice"))
+	if err == nil {
+		t.Errorf("db.AddProfile(\"Alice\") succeeded twice")
+	}
+	profiles, err := db.AllProfiles()
+	if err != nil || len(profiles) != 2 {
+		t.Errorf("db.AllProfiles() = %v, %v", profiles, err)
+		return
+	}
+	testTime := time.Unix(1234567, 0)
+	err = db.SetProfileActiveUntil("Alice", testTime)
+	if err != nil {
+		t.Errorf("db.SetProfileActiveUntil(\"Alice\", %v) = %v", testTime, err)
+		return
+	}
+	if !profiles[0].ActiveUntil.IsZero() {
+		t.Errorf("db.SetProfileActiveUntil() changed the result of an earlier db.AllProfiles(): %v", profiles[0])
+	}
+	delta := time.Hour
+	baseTime := testTime.Add(-time.Minute)
+	err = db.ModifyProfileActiveUntil("Alice", delta, baseTime)
+	if err != nil {
+		t.Errorf("db.ModifyProfileActiveUntil(\"Alice\", %v, %v) = %v", delta, baseTime, err)
+		return
+	}
+	profile, found, err := db.FindProfile("Alice")
+	expected := testTime.Add(delta)
+	if err != nil || !found || !profile.ActiveUntil.Equal(expected) {
+		t.Errorf("db.FindProfile(\"Alice\") = %v, %v, %v, expected ActiveUntil %v", profile, found, err, expected)
+		return
+	}
+	err = db.RemoveProfile("Alice")
+	if err != nil {
+		t.Errorf("db.RemoveProfile(\"Alice\") = %v", err)
+		return
+	}
+	profile, found, err = db.FindProfile("Alice")
+	if err != nil || found {
+		t.Errorf("after remove db.FindProfile(\"Alice\") = %v, %v, %v", profile, found, err)
+		return
+	}
+}
+
+func exerciseTimeRequests(t *testing.T, db DB) {
+	ip := ParseDeviceIP("192.168.1.201")
+	created := time.Unix(1234567, 0)
+	var ids []int
+	for i := 0; i < 2; i++ {
+		id, err := db.AddTimeRequest(NewTimeRequest(ip, time.Hour, created))
+		if err != nil {
+			t.Errorf("db.AddTimeRequest() = %v", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("db.AddTimeRequest() returned the same ID twice: %v", ids)
+		return
+	}
+	answered := created.Add(time.Minute)
+	err := db.SetTimeRequestStatus(ids[0], TimeRequestApproved, answered)
+	if err != nil {
+		t.Errorf("db.SetTimeRequestStatus(%d) = %v", ids[0], err)
+		return
+	}
+	request, found, err := db.FindTimeRequest(ids[0])
+	if err != nil || !found || request.Status != TimeRequestApproved ||
+		!request.Answered.Equal(answered) || !request.IP.Equal(ip) {
+		t.Errorf("db.FindTimeRequest(%d) = %v, %v, %v", ids[0], request, found, err)
+		return
+	}
+	err = db.RemoveTimeRequest(ids[0])
+	if err != nil {
+		t.Errorf("db.RemoveTimeRequest(%d) = %v", ids[0], err)
+		return
+	}
+	requests, err := db.AllTimeRequests()
+	if err != nil || len(requests) != 1 || requests[0].ID != ids[1] {
+		t.Errorf("db.AllTimeRequests() = %v, %v", requests, err)
+		return
+	}
 }
 
 func getActiveUntilHelper(db DB, ip DeviceIP) (activeUntil time.Time, err error) {
@@ -179,7 +273,7 @@ func loadDB(t *testing.T, db DB) (err error) {
 
 func convertEntriesToDevices(entries []entry) (devices []Device) {
 	for _, e := range entries {
-		d := Device{ParseDeviceIP(e.ip), e.name, time.Time{}}
+		d := Device{IP: ParseDeviceIP(e.ip), Name: e.name}
 		devices = append(devices, d)
 	}
 	return
@@ -0,0 +1,282 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A file-based DB keeps its contents in RAM, and writes a snapshot to disk
+// after every change. Snapshots are written to a temporary file, fsync'd, and
+// then renamed over the previous snapshot, so a crash leaves either the old
+// or the new contents on disk, never a mixture.
+func NewFileDB(path string) (d DB) {
+	return &file{path: path}
+}
+
+type file struct {
+	// Serializes changes so that snapshots are written in the same order as
+	// the changes they record.
+	mutex sync.Mutex
+	path  string
+	ram   ram
+}
+
+// The on-disk format of a file-based DB.
+type fileSnapshot struct {
+	Devices           []Device
+	Profiles          []Profile
+	TimeRequests      []TimeRequest
+	NextTimeRequestID int
+}
+
+func (f *file) Open() (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		// A new database.
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	var snapshot fileSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return
+	}
+	f.restore(snapshot)
+	return
+}
+
+// Returns a copy of the contents of f.ram.
+func (f *file) snapshot() fileSnapshot {
+	f.ram.mutex.RLock()
+	defer f.ram.mutex.RUnlock()
+	return fileSnapshot{
+		append([]Device(nil), f.ram.devices...),
+		append([]Profile(nil), f.ram.profiles...),
+		append([]TimeRequest(nil), f.ram.timeRequests...),
+		f.ram.nextTimeRequestID,
+	}
+}
+
+// Replaces the contents of f.ram.
+func (f *file) restore(snapshot fileSnapshot) {
+	f.ram.mutex.Lock()
+	defer f.ram.mutex.Unlock()
+	f.ram.devices = snapshot.Devices
+	f.ram.profiles = snapshot.Profiles
+	f.ram.timeRequests = snapshot.TimeRequests
+	f.ram.nextTimeRequestID = snapshot.NextTimeRequestID
+}
+
+// Must be called with f.mutex held.
+func (f *file) save() (err error) {
+	data, err := json.MarshalIndent(f.snapshot(), "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFileAtomic(f.path, data)
+	return
+}
+
+// Applies a change to f.ram, and saves it. If the save fails, the change is
+// undone, so that memory never has changes that the disk doesn't.
+// Must be called with f.mutex held.
+func (f *file) change(apply func() error) (err error) {
+	before := f.snapshot()
+	err = apply()
+	if err != nil {
+		return
+	}
+	err = f.save()
+	if err != nil {
+		f.restore(before)
+	}
+	return
+}
+
+func (f *file) Add(d Device) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.Add(d) })
+}
+
+func (f *file) AddAll(devices []Device) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.AddAll(devices) })
+}
+
+func (f *file) Remove(ip DeviceIP) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.Remove(ip) })
+}
+
+func (f *file) Find(ip DeviceIP) (device Device, found bool, err error) {
+	return f.ram.Find(ip)
+}
+
+func (f *file) All() (devices []Device, err error) {
+	return f.ram.All()
+}
+
+func (f *file) SetActiveUntil(ip DeviceIP, activeUntil time.Time) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.SetActiveUntil(ip, activeUntil) })
+}
+
+func (f *file) SetDeviceConfig(d Device) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.SetDeviceConfig(d) })
+}
+
+func (f *file) ModifyActiveUntil(ip DeviceIP, delta time.Duration,
+	baseTime time.Time) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.ModifyActiveUntil(ip, delta, baseTime) })
+}
+
+func (f *file) AddProfile(p Profile) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.AddProfile(p) })
+}
+
+func (f *file) RemoveProfile(name string) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.RemoveProfile(name) })
+}
+
+func (f *file) FindProfile(name string) (profile Profile, found bool, err error) {
+	return f.ram.FindProfile(name)
+}
+
+func (f *file) AllProfiles() (profiles []Profile, err error) {
+	return f.ram.AllProfiles()
+}
+
+func (f *file) SetProfileActiveUntil(name string, activeUntil time.Time) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.SetProfileActiveUntil(name, activeUntil) })
+}
+
+func (f *file) ModifyProfileActiveUntil(name string, delta time.Duration,
+	baseTime time.Time) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.ModifyProfileActiveUntil(name, delta, baseTime) })
+}
+
+func (f *file) SetProfileQuotaUsage(name string, usage QuotaUsage) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.SetProfileQuotaUsage(name, usage) })
+}
+
+func (f *file) SetProfileConfig(p Profile) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.SetProfileConfig(p) })
+}
+
+func (f *file) AddTimeRequest(request TimeRequest) (id int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = f.change(func() (err error) {
+		id, err = f.ram.AddTimeRequest(request)
+		return
+	})
+	return
+}
+
+func (f *file) RemoveTimeRequest(id int) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.RemoveTimeRequest(id) })
+}
+
+func (f *file) FindTimeRequest(id int) (request TimeRequest, found bool, err error) {
+	return f.ram.FindTimeRequest(id)
+}
+
+func (f *file) AllTimeRequests() (requests []TimeRequest, err error) {
+	return f.ram.AllTimeRequests()
+}
+
+func (f *file) SetTimeRequestStatus(id int, status TimeRequestStatus,
+	answered time.Time) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.change(func() error { return f.ram.SetTimeRequestStatus(id, status, answered) })
+}
+
+func (f *file) Close() (err error) {
+	return
+}
+
+// Replace the contents of path with data. Either the old or the new contents
+// will be present after a crash.
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, base+".tmp")
+	if err != nil {
+		return
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpName)
+		}
+	}()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpName, path)
+	if err != nil {
+		return
+	}
+	err = syncDir(dir)
+	return
+}
+
+// Make a rename durable by syncing the directory that contains it.
+func syncDir(dir string) (err error) {
+	if runtime.GOOS == "windows" {
+		// Windows can't sync directories, and doesn't need to.
+		return
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	err = d.Sync()
+	return
+}
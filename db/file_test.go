@@ -0,0 +1,240 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withTempDir(t *testing.T, f func(dir string)) {
+	dir, err := ioutil.TempDir("", "seattlesnowman")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	f(dir)
+}
+
+func TestFile(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		db := NewFileDB(filepath.Join(dir, "db.json"))
+		exerciseDB(t, db)
+	})
+}
+
+func TestFilePersists(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		path := filepath.Join(dir, "db.json")
+		db := NewFileDB(path)
+		err := db.Open()
+		if err != nil {
+			t.Errorf("db.Open() = %v", err)
+			return
+		}
+		err = loadDB(t, db)
+		if err != nil {
+			t.Errorf("loadDB() = %v", err)
+			return
+		}
+		ip := ParseDeviceIP(testData[1].ip)
+		activeUntil := time.Date(2015, 3, 3, 20, 0, 0, 0, time.UTC)
+		err = db.SetActiveUntil(ip, activeUntil)
+		if err != nil {
+			t.Errorf("db.SetActiveUntil(%v,%v) = %v", ip, activeUntil, err)
+			return
+		}
+		requestID, err := db.AddTimeRequest(NewTimeRequest(ip, time.Hour, activeUntil))
+		if err != nil {
+			t.Errorf("db.AddTimeRequest() = %v", err)
+			return
+		}
+		testClose(t, db)
+
+		reopened := NewFileDB(path)
+		err = reopened.Open()
+		if err != nil {
+			t.Errorf("reopened.Open() = %v", err)
+			return
+		}
+		defer testClose(t, reopened)
+		devices, err := reopened.All()
+		if err != nil || len(devices) != len(testData) {
+			t.Errorf("reopened.All() = %v, %v", devices, err)
+			return
+		}
+		for i, d := range devices {
+			if !d.IP.Equal(ParseDeviceIP(testData[i].ip)) || d.Name != testData[i].name {
+				t.Errorf("reopened device %d = %v, expected %v", i, d, testData[i])
+			}
+		}
+		got, err := getActiveUntilHelper(reopened, ip)
+		if err != nil {
+			t.Errorf("getActiveUntilHelper(%v) = %v", ip, err)
+			return
+		}
+		if !got.Equal(activeUntil) {
+			t.Errorf("reopened ActiveUntil = %v, expected %v", got, activeUntil)
+		}
+		request, found, err := reopened.FindTimeRequest(requestID)
+		if err != nil || !found || request.Status != TimeRequestPending {
+			t.Errorf("reopened.FindTimeRequest(%d) = %v, %v, %v", requestID, request, found, err)
+		}
+		nextID, err := reopened.AddTimeRequest(NewTimeRequest(ip, time.Hour, activeUntil))
+		if err != nil || nextID == requestID {
+			t.Errorf("reopened.AddTimeRequest() = %v, %v, expected a new ID", nextID, err)
+		}
+	})
+}
+
+func TestFileUndoesChangesThatFailToSave(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		sub := filepath.Join(dir, "sub")
+		err := os.Mkdir(sub, 0700)
+		if err != nil {
+			t.Fatalf("os.Mkdir() = %v", err)
+		}
+		path := filepath.Join(sub, "db.json")
+		db := NewFileDB(path)
+		err = db.Open()
+		if err != nil {
+			t.Fatalf("db.Open() = %v", err)
+		}
+		defer testClose(t, db)
+		err = db.Add(NewDevice("192.168.1.201", "laptop"))
+		if err != nil {
+			t.Fatalf("db.Add() = %v", err)
+		}
+
+		// Snapshots can't be written while the directory is gone.
+		err = os.RemoveAll(sub)
+		if err != nil {
+			t.Fatalf("os.RemoveAll() = %v", err)
+		}
+		err = db.Add(NewDevice("192.168.1.202", "phone"))
+		if err == nil {
+			t.Errorf("db.Add() succeeded without a directory to save to")
+		}
+		devices, err := db.All()
+		if err != nil || len(devices) != 1 {
+			t.Errorf("db.All() after a failed save = %v, %v, expected only the laptop", devices, err)
+		}
+
+		err = os.Mkdir(sub, 0700)
+		if err != nil {
+			t.Fatalf("os.Mkdir() = %v", err)
+		}
+		err = db.Add(NewDevice("192.168.1.203", "console"))
+		if err != nil {
+			t.Fatalf("db.Add() = %v", err)
+		}
+		reopened := NewFileDB(path)
+		err = reopened.Open()
+		if err != nil {
+			t.Fatalf("reopened.Open() = %v", err)
+		}
+		defer testClose(t, reopened)
+		devices, err = reopened.All()
+		if err != nil || len(devices) != 2 || devices[1].Name != "console" {
+			t.Errorf("reopened.All() = %v, %v, expected the laptop and the console", devices, err)
+		}
+	})
+}
+
+func TestFileSetDeviceConfig(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		path := filepath.Join(dir, "db.json")
+		db := NewFileDB(path)
+		err := db.Open()
+		if err != nil {
+			t.Fatalf("db.Open() = %v", err)
+		}
+		device := NewDevice("192.168.1.201", "laptop")
+		device.Calendar = "school"
+		err = db.Add(device)
+		if err != nil {
+			t.Fatalf("db.Add() = %v", err)
+		}
+		activeUntil := time.Date(2015, 3, 3, 20, 0, 0, 0, time.UTC)
+		err = db.SetActiveUntil(device.IP, activeUntil)
+		if err != nil {
+			t.Fatalf("db.SetActiveUntil() = %v", err)
+		}
+		testClose(t, db)
+
+		// The configuration changes before the next start.
+		reopened := NewFileDB(path)
+		err = reopened.Open()
+		if err != nil {
+			t.Fatalf("reopened.Open() = %v", err)
+		}
+		defer testClose(t, reopened)
+		changed := NewDevice("192.168.1.201", "old-laptop")
+		changed.Profile = "Alice"
+		err = reopened.SetDeviceConfig(changed)
+		if err != nil {
+			t.Fatalf("reopened.SetDeviceConfig() = %v", err)
+		}
+		actual, found, err := reopened.Find(device.IP)
+		if err != nil || !found || actual.Name != "old-laptop" || actual.Calendar != "" ||
+			actual.Profile != "Alice" || !actual.ActiveUntil.Equal(activeUntil) {
+			t.Errorf("reopened.Find() after SetDeviceConfig() = %v, %v, %v", actual, found, err)
+		}
+	})
+}
+
+func TestFileSetProfileConfig(t *testing.T) {
+	withTempDir(t, func(dir string) {
+		path := filepath.Join(dir, "db.json")
+		db := NewFileDB(path)
+		err := db.Open()
+		if err != nil {
+			t.Fatalf("db.Open() = %v", err)
+		}
+		profile := NewProfile("Carol")
+		profile.DailyQuota = Duration(2 * time.Hour)
+		err = db.AddProfile(profile)
+		if err != nil {
+			t.Fatalf("db.AddProfile() = %v", err)
+		}
+		activeUntil := time.Date(2015, 3, 3, 20, 0, 0, 0, time.UTC)
+		err = db.SetProfileActiveUntil("Carol", activeUntil)
+		if err != nil {
+			t.Fatalf("db.SetProfileActiveUntil() = %v", err)
+		}
+		usage := QuotaUsage{Day: activeUntil.Add(-20 * time.Hour), DayUsed: Duration(time.Hour)}
+		err = db.SetProfileQuotaUsage("Carol", usage)
+		if err != nil {
+			t.Fatalf("db.SetProfileQuotaUsage() = %v", err)
+		}
+		testClose(t, db)
+
+		// The configuration changes before the next start.
+		reopened := NewFileDB(path)
+		err = reopened.Open()
+		if err != nil {
+			t.Fatalf("reopened.Open() = %v", err)
+		}
+		defer testClose(t, reopened)
+		changed := NewProfile("Carol")
+		changed.Calendar = "teen"
+		changed.DailyQuota = Duration(3 * time.Hour)
+		changed.WeeklyQuota = Duration(10 * time.Hour)
+		err = reopened.SetProfileConfig(changed)
+		if err != nil {
+			t.Fatalf("reopened.SetProfileConfig() = %v", err)
+		}
+		actual, found, err := reopened.FindProfile("Carol")
+		if err != nil || !found || actual.Calendar != "teen" ||
+			actual.DailyQuota != changed.DailyQuota || actual.WeeklyQuota != changed.WeeklyQuota {
+			t.Errorf("reopened.FindProfile() after SetProfileConfig() = %v, %v, %v", actual, found, err)
+		}
+		if !actual.ActiveUntil.Equal(activeUntil) || !actual.QuotaUsage.Day.Equal(usage.Day) ||
+			actual.QuotaUsage.DayUsed != usage.DayUsed {
+			t.Errorf("SetProfileConfig() changed the granted time or quota usage: %v", actual)
+		}
+	})
+}
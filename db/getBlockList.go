@@ -30,29 +30,78 @@ func minTime(a time.Time, b time.Time) time.Time {
 	return b
 }
 
-func GetBlockList(db DB, calendar Calendar, atTime time.Time) (blocked []DeviceIP, goodUntil time.Time, err error) {
+// A calendar's rule at a particular time.
+type calendarRule struct {
+	isOn   bool
+	period TimePeriod
+}
+
+// Returns the devices that should be blocked at atTime, each according to its
+// own calendar, along with the time when the block list will next change.
+// Devices that belong to a profile use the profile's calendar, unless they
+// have a calendar of their own, and are active while the profile is.
+func GetBlockList(db DB, calendars Calendars, atTime time.Time) (blocked []DeviceIP, goodUntil time.Time, err error) {
+	return getBlockList(db, calendars, atTime, true)
+}
+
+// Returns the devices that their calendars alone would block at atTime,
+// ignoring the time given to devices and profiles, and quota sessions.
+func GetCalendarBlockList(db DB, calendars Calendars, atTime time.Time) (blocked []DeviceIP, err error) {
+	blocked, _, err = getBlockList(db, calendars, atTime, false)
+	return
+}
+
+func getBlockList(db DB, calendars Calendars, atTime time.Time, withGrants bool) (blocked []DeviceIP, goodUntil time.Time, err error) {
 	all, err := db.All()
 	if err != nil {
 		return
 	}
-	calendarActive, calendarPeriod := calendar.RuleAt(atTime)
+	allProfiles, err := db.AllProfiles()
+	if err != nil {
+		return
+	}
+	profiles := make(map[string]Profile)
+	for _, p := range allProfiles {
+		profiles[p.Name] = p
+	}
+	rules := make(map[string]calendarRule)
 	for _, d := range all {
+		var profile Profile
+		if d.Profile != "" {
+			profile = profiles[d.Profile]
+		}
+		calendarName := d.Calendar
+		if calendarName == "" {
+			calendarName = profile.Calendar
+		}
+		rule, ok := rules[calendarName]
+		if !ok {
+			rule.isOn, rule.period = calendars.For(calendarName).RuleAt(atTime)
+			rules[calendarName] = rule
+		}
 		deviceActiveEnd := time.Time{}
-		if calendarActive {
-			deviceActiveEnd = calendarPeriod.End
+		if profile.HasQuota() {
+			// Only active during quota sessions, which end before the
+			// calendar turns off.
+			if withGrants {
+				deviceActiveEnd = profile.QuotaUsage.sessionEndAt(atTime)
+			}
+		} else if rule.isOn {
+			deviceActiveEnd = rule.period.End
 		}
-		dbActiveUntil := d.ActiveUntil
-		if !dbActiveUntil.IsZero() && dbActiveUntil.After(atTime) {
+		dbActiveUntil := maxTime(d.ActiveUntil, profile.ActiveUntil)
+		if withGrants && !dbActiveUntil.IsZero() && dbActiveUntil.After(atTime) {
 			deviceActiveEnd = maxTime(deviceActiveEnd, dbActiveUntil)
 		}
 		if atTime.Before(deviceActiveEnd) {
 			goodUntil = minTime(goodUntil, deviceActiveEnd)
 		} else {
 			blocked = append(blocked, d.IP)
+			if !profile.HasQuota() {
+				// Blocked until its calendar turns on.
+				goodUntil = minTime(goodUntil, rule.period.End)
+			}
 		}
 	}
-	if goodUntil.IsZero() && !calendarActive {
-		goodUntil = calendarPeriod.End
-	}
 	return
 }
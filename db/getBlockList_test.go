@@ -23,30 +23,158 @@ var getBlockListTestCases = []gbltc{
 	gbltc{"3/3/15", "9:00PM", 0, "4:00PM", ""},        // Tuesday, schoolday
 }
 
+// Before and after school, with a gap in the middle of the day.
+var multipleWindowGetBlockListTestCases = []gbltc{
+	gbltc{"3/2/15", "6:00AM", 0, "7:00AM", ""},        // Monday, before school
+	gbltc{"3/2/15", "7:30AM", 3, "8:00AM", ""},        // Monday, before school
+	gbltc{"3/2/15", "8:30AM", 0, "4:00PM", ""},        // Monday, school
+	gbltc{"3/2/15", "8:30AM", 1, "10:00AM", "extend"}, // Monday, school One extended
+	gbltc{"3/2/15", "4:30PM", 3, "8:00PM", ""},        // Monday, after school
+	gbltc{"3/2/15", "9:00PM", 0, "7:00AM", ""},        // Monday, school night
+}
+
 func TestGetBlockList(t *testing.T) {
-	db := NewSQLDB(":memory:")
-	err := db.Open()
+	testGetBlockList(t, calendarConfig, getBlockListTestCases)
+}
+
+func TestGetBlockListMultipleWindows(t *testing.T) {
+	testGetBlockList(t, multipleWindowCalendarConfig, multipleWindowGetBlockListTestCases)
+}
+
+// Teenagers stay up later, and little kids go to bed earlier.
+var namedCalendarConfigs = map[string]CalendarConfig{
+	"teen": CalendarConfig{
+		Location:       "America/Los_Angeles",
+		SchoolDayHours: TimeOfDayPeriodsConfig{{"4:00PM", "10:00PM"}},
+		VacationHours:  TimeOfDayPeriodsConfig{{"1:00PM", "11:00PM"}},
+	},
+	"little": CalendarConfig{
+		Location:       "America/Los_Angeles",
+		SchoolDayHours: TimeOfDayPeriodsConfig{{"3:00PM", "7:00PM"}},
+		VacationHours:  TimeOfDayPeriodsConfig{{"9:00AM", "7:00PM"}},
+	},
+}
+
+var perDeviceCalendarDevices = []Device{
+	Device{IP: ParseDeviceIP("192.168.4.100"), Name: "Able"},
+	Device{IP: ParseDeviceIP("192.168.4.101"), Name: "Baker", Calendar: "teen"},
+	Device{IP: ParseDeviceIP("192.168.4.102"), Name: "Charlie", Calendar: "little"},
+}
+
+var perDeviceCalendarGetBlockListTestCases = []gbltc{
+	gbltc{"3/3/15", "1:00PM", 0, "3:00PM", ""},       // Tuesday, schoolday
+	gbltc{"3/3/15", "3:30PM", 1, "4:00PM", ""},       // Little kid first
+	gbltc{"3/3/15", "5:00PM", 3, "7:00PM", ""},       // Everybody
+	gbltc{"3/3/15", "7:30PM", 2, "8:00PM", ""},       // Little kid in bed
+	gbltc{"3/3/15", "9:00PM", 1, "10:00PM", ""},      // Teenager last
+	gbltc{"3/3/15", "9:00PM", 2, "9:30PM", "extend"}, // Teenager last, One extended
+	gbltc{"3/3/15", "10:30PM", 0, "3:00PM", ""},      // Everybody in bed
+	gbltc{"3/7/15", "10:00AM", 1, "1:00PM", ""},      // Saturday
+}
+
+func TestGetBlockListPerDeviceCalendar(t *testing.T) {
+	calendars, err := NewCalendars(calendarConfig, namedCalendarConfigs)
+	if err != nil {
+		t.Errorf("NewCalendars(%v, %v) = %v", calendarConfig, namedCalendarConfigs, err)
+		return
+	}
+	testGetBlockListWith(t, calendars, perDeviceCalendarDevices, perDeviceCalendarGetBlockListTestCases)
+}
+
+func TestGetBlockListProfiles(t *testing.T) {
+	calendars, err := NewCalendars(calendarConfig, namedCalendarConfigs)
+	if err != nil {
+		t.Errorf("NewCalendars(%v, %v) = %v", calendarConfig, namedCalendarConfigs, err)
+		return
+	}
+	db := NewRAMDB()
+	err = db.Open()
 	if err != nil {
 		t.Errorf("db.Open() = %v", err)
 		return
 	}
 	defer testClose(t, db)
-	err = loadDB(t, db)
+	devices := convertEntriesToDevices(testData)
+	devices[0].Profile = "Alice"
+	devices[1].Profile = "Alice"
+	devices[2].Profile = "Bob"
+	devices[2].Calendar = "teen" // Overrides the profile's calendar.
+	err = db.AddAll(devices)
 	if err != nil {
+		t.Errorf("db.AddAll() = %v", err)
 		return
 	}
+	alice := NewProfile("Alice")
+	alice.Calendar = "little"
+	bob := NewProfile("Bob")
+	for _, p := range []Profile{alice, bob} {
+		err = db.AddProfile(p)
+		if err != nil {
+			t.Errorf("db.AddProfile(%v) = %v", p, err)
+			return
+		}
+	}
+	location := calendars[""].(*timeClock).location
+	at := func(hour, minute int) time.Time {
+		return time.Date(2015, 3, 3, hour, minute, 0, 0, location) // Tuesday
+	}
+
+	blocked, goodUntil, err := GetBlockList(db, calendars, at(19, 30))
+	if err != nil || len(blocked) != 2 || !goodUntil.Equal(at(22, 0)) {
+		t.Errorf("GetBlockList(7:30PM) = %v, %v, %v", blocked, goodUntil, err)
+	}
+
+	// A grant to Alice unblocks all of her devices, until the same time.
+	err = db.SetProfileActiveUntil("Alice", at(20, 30))
+	if err != nil {
+		t.Errorf("db.SetProfileActiveUntil() = %v", err)
+		return
+	}
+	blocked, goodUntil, err = GetBlockList(db, calendars, at(19, 30))
+	if err != nil || len(blocked) != 0 || !goodUntil.Equal(at(20, 30)) {
+		t.Errorf("GetBlockList(7:30PM) after grant = %v, %v, %v", blocked, goodUntil, err)
+	}
+	// The calendars alone still block Alice's devices.
+	blocked, err = GetCalendarBlockList(db, calendars, at(19, 30))
+	if err != nil || len(blocked) != 2 {
+		t.Errorf("GetCalendarBlockList(7:30PM) after grant = %v, %v", blocked, err)
+	}
+	blocked, goodUntil, err = GetBlockList(db, calendars, at(20, 30))
+	if err != nil || len(blocked) != 2 || !goodUntil.Equal(at(22, 0)) {
+		t.Errorf("GetBlockList(8:30PM) after grant = %v, %v, %v", blocked, goodUntil, err)
+	}
+}
+
+func testGetBlockList(t *testing.T, calendarConfig *CalendarConfig, testCases []gbltc) {
 	calendar, err := NewCalendar(calendarConfig)
 	if err != nil {
 		t.Errorf("NewCalendar(%v) = %v", calendarConfig, err)
 		return
 	}
+	testGetBlockListWith(t, Calendars{"": calendar}, convertEntriesToDevices(testData), testCases)
+}
+
+func testGetBlockListWith(t *testing.T, calendars Calendars, devices []Device, testCases []gbltc) {
+	db := NewRAMDB()
+	err := db.Open()
+	if err != nil {
+		t.Errorf("db.Open() = %v", err)
+		return
+	}
+	defer testClose(t, db)
+	err = db.AddAll(devices)
+	if err != nil {
+		t.Errorf("db.AddAll() = %v", err)
+		return
+	}
+	calendar := calendars[""]
 	tc, ok := calendar.(*timeClock)
 	if !ok {
 		t.Errorf("calender is not a *timeClock. %v", calendar)
 		return
 	}
 
-	for i, gbltc := range getBlockListTestCases {
+	for i, gbltc := range testCases {
 		date, err := ParseDate(gbltc.date, tc.location)
 		if err != nil {
 			t.Errorf("case %d. ParseDate(%s,%s) = %v", i, gbltc.date, tc.location, err)
@@ -72,11 +200,11 @@ func TestGetBlockList(t *testing.T) {
 		if gbltc.special == "extend" {
 			err = db.SetActiveUntil(ParseDeviceIP("192.168.4.100"), expectedGoodUntilTime)
 			if err != nil {
-				t.Errorf("case %d: db.SetActiveUntil(%v) = %v", gbltc.date, expectedGoodUntilTime, err)
+				t.Errorf("case %d: db.SetActiveUntil(%v) = %v", i, expectedGoodUntilTime, err)
 			}
 		}
 
-		blocked, goodUntil, err := GetBlockList(db, calendar, probeTime)
+		blocked, goodUntil, err := GetBlockList(db, calendars, probeTime)
 		if err != nil {
 			t.Errorf("case %d: %s GetBlockList(%v) = %v", i, gbltc.date, gbltc.probe, err)
 			continue
@@ -85,7 +213,7 @@ func TestGetBlockList(t *testing.T) {
 			t.Errorf("case %d: %s GetBlockList(%v) = %v, expected %v", i, gbltc.date, gbltc.probe, goodUntil, expectedGoodUntilTime)
 		}
 
-		active := 3 - len(blocked)
+		active := len(devices) - len(blocked)
 		if active != gbltc.active {
 			t.Errorf("case %d: %s GetBlockList(%v) -> %v active %v, expected %v", i, gbltc.date, gbltc.probe, blocked, active, gbltc.active)
 		}
@@ -94,7 +222,7 @@ func TestGetBlockList(t *testing.T) {
 		if gbltc.special == "extend" {
 			err = db.SetActiveUntil(ParseDeviceIP("192.168.4.100"), time.Time{})
 			if err != nil {
-				t.Errorf("case %d: db.SetActiveUntil(%v) = %v", gbltc.date, time.Time{}, err)
+				t.Errorf("case %d: db.SetActiveUntil(%v) = %v", i, time.Time{}, err)
 			}
 		}
 	}
@@ -0,0 +1,190 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// A time.Duration that is written as text, like "2h30m", in JSON.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	duration, err := time.ParseDuration(string(text))
+	*d = Duration(duration)
+	return
+}
+
+// How much of a profile's quota has been used.
+//
+// Internet time is spent in sessions. A session's end is decided when it
+// starts, so the time used so far can always be computed from the session's
+// start and end, and nothing needs to be updated while a session runs.
+type QuotaUsage struct {
+	Day          time.Time // Start of the quota day that DayUsed counts.
+	DayUsed      Duration  // Not counting the current session.
+	Week         time.Time // Start of the quota week that WeekUsed counts.
+	WeekUsed     Duration  // Not counting the current session.
+	SessionStart time.Time // Zero if there is no session.
+	SessionEnd   time.Time
+}
+
+// The state of a profile's quota at a particular time.
+type QuotaStatus struct {
+	Remaining    Duration
+	UsedToday    Duration
+	UsedThisWeek Duration
+	SessionEnd   time.Time // Zero if there is no current session.
+}
+
+func (p Profile) HasQuota() bool {
+	return p.DailyQuota > 0 || p.WeeklyQuota > 0
+}
+
+// Returns the end of the session that is running at t, or zero if there is
+// none.
+func (u QuotaUsage) sessionEndAt(t time.Time) time.Time {
+	if !u.SessionStart.After(t) && u.SessionEnd.After(t) {
+		return u.SessionEnd
+	}
+	return time.Time{}
+}
+
+// Returns how much of the period from start until t was spent in the
+// session.
+func (u QuotaUsage) sessionUsed(start time.Time, t time.Time) time.Duration {
+	if u.SessionStart.IsZero() {
+		return 0
+	}
+	from := maxTime(u.SessionStart, start)
+	to := u.SessionEnd
+	if t.Before(to) {
+		to = t
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// Returns the usage at t, with the session's time added to the totals and
+// the session removed.
+func (u QuotaUsage) settle(t time.Time, day TimePeriod, week TimePeriod) (settled QuotaUsage) {
+	settled.Day = day.Start
+	if u.Day.Equal(day.Start) {
+		settled.DayUsed = u.DayUsed
+	}
+	settled.DayUsed += Duration(u.sessionUsed(day.Start, t))
+	settled.Week = week.Start
+	if u.Week.Equal(week.Start) {
+		settled.WeekUsed = u.WeekUsed
+	}
+	settled.WeekUsed += Duration(u.sessionUsed(week.Start, t))
+	return
+}
+
+func remainingQuota(quota Duration, used Duration) Duration {
+	if used >= quota {
+		return 0
+	}
+	return quota - used
+}
+
+// Returns the state of the profile's quota at t.
+func quotaStatus(p Profile, calendar Calendar, t time.Time) (status QuotaStatus) {
+	day, week := calendar.QuotaPeriodsAt(t)
+	settled := p.QuotaUsage.settle(t, day, week)
+	status.UsedToday = settled.DayUsed
+	status.UsedThisWeek = settled.WeekUsed
+	status.SessionEnd = p.QuotaUsage.sessionEndAt(t)
+	switch {
+	case p.DailyQuota > 0 && p.WeeklyQuota > 0:
+		status.Remaining = remainingQuota(p.DailyQuota, settled.DayUsed)
+		if weekRemaining := remainingQuota(p.WeeklyQuota, settled.WeekUsed); weekRemaining < status.Remaining {
+			status.Remaining = weekRemaining
+		}
+	case p.DailyQuota > 0:
+		status.Remaining = remainingQuota(p.DailyQuota, settled.DayUsed)
+	case p.WeeklyQuota > 0:
+		status.Remaining = remainingQuota(p.WeeklyQuota, settled.WeekUsed)
+	}
+	return
+}
+
+func findQuotaProfile(db DB, name string) (profile Profile, err error) {
+	profile, found, err := db.FindProfile(name)
+	if err != nil {
+		return
+	}
+	if !found {
+		err = fmt.Errorf("Unknown profile %q", name)
+		return
+	}
+	if !profile.HasQuota() {
+		err = fmt.Errorf("Profile %q does not have a quota", name)
+		return
+	}
+	return
+}
+
+// Returns the state of the named profile's quota at t.
+func GetQuotaStatus(db DB, calendars Calendars, name string, t time.Time) (status QuotaStatus, err error) {
+	profile, err := findQuotaProfile(db, name)
+	if err != nil {
+		return
+	}
+	status = quotaStatus(profile, calendars.For(profile.Calendar), t)
+	return
+}
+
+// Start spending the named profile's quota at t. The session lasts until the
+// quota runs out, the profile's calendar turns off, or the quota day ends,
+// whichever comes first.
+func StartQuotaSession(db DB, calendars Calendars, name string, t time.Time) (err error) {
+	profile, err := findQuotaProfile(db, name)
+	if err != nil {
+		return
+	}
+	calendar := calendars.For(profile.Calendar)
+	if !profile.QuotaUsage.sessionEndAt(t).IsZero() {
+		// Already started.
+		return
+	}
+	isOn, period := calendar.RuleAt(t)
+	if !isOn {
+		err = fmt.Errorf("Profile %q can't use the Internet until %s", name,
+			period.End.Format(time.Kitchen))
+		return
+	}
+	status := quotaStatus(profile, calendar, t)
+	if status.Remaining <= 0 {
+		err = fmt.Errorf("Profile %q has no time left", name)
+		return
+	}
+	day, week := calendar.QuotaPeriodsAt(t)
+	usage := profile.QuotaUsage.settle(t, day, week)
+	usage.SessionStart = t
+	usage.SessionEnd = minTime(minTime(t.Add(time.Duration(status.Remaining)), period.End), day.End)
+	err = db.SetProfileQuotaUsage(name, usage)
+	return
+}
+
+// Stop spending the named profile's quota at t.
+func StopQuotaSession(db DB, calendars Calendars, name string, t time.Time) (err error) {
+	profile, err := findQuotaProfile(db, name)
+	if err != nil {
+		return
+	}
+	day, week := calendars.For(profile.Calendar).QuotaPeriodsAt(t)
+	err = db.SetProfileQuotaUsage(name, profile.QuotaUsage.settle(t, day, week))
+	return
+}
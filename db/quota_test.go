@@ -0,0 +1,172 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package db
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Quota periods test case
+type qptc struct {
+	probe     string // Date and time
+	dayStart  string
+	weekStart string
+}
+
+var quotaPeriodsTestCases = []qptc{
+	qptc{"3/3/15 3:59AM", "3/2/15 4:00AM", "2/28/15 4:00AM"}, // Tuesday
+	qptc{"3/3/15 4:00AM", "3/3/15 4:00AM", "2/28/15 4:00AM"},
+	qptc{"2/28/15 3:00AM", "2/27/15 4:00AM", "2/21/15 4:00AM"}, // Saturday
+	qptc{"2/28/15 5:00AM", "2/28/15 4:00AM", "2/28/15 4:00AM"},
+	qptc{"3/6/15 11:00PM", "3/6/15 4:00AM", "2/28/15 4:00AM"}, // Friday
+}
+
+func TestQuotaPeriods(t *testing.T) {
+	cc := *calendarConfig
+	cc.QuotaResetTime = "4:00AM"
+	cc.QuotaResetDay = "Saturday"
+	calendar, err := NewCalendar(&cc)
+	if err != nil {
+		t.Errorf("NewCalendar(%v) = %v", cc, err)
+		return
+	}
+	location := calendar.(*timeClock).location
+	parse := func(s string) time.Time {
+		result, err := time.ParseInLocation(DateFormat+" "+time.Kitchen, s, location)
+		if err != nil {
+			t.Fatalf("time.ParseInLocation(%q) = %v", s, err)
+		}
+		return result
+	}
+	for i, tc := range quotaPeriodsTestCases {
+		day, week := calendar.QuotaPeriodsAt(parse(tc.probe))
+		dayStart := parse(tc.dayStart)
+		weekStart := parse(tc.weekStart)
+		checkEqualTimePeriod(t, "day", day, TimePeriod{dayStart, dayStart.AddDate(0, 0, 1)})
+		checkEqualTimePeriod(t, "week", week, TimePeriod{weekStart, weekStart.AddDate(0, 0, 7)})
+		if t.Failed() {
+			t.Errorf("case %d: QuotaPeriodsAt(%v) = %v, %v", i, tc.probe, day, week)
+			return
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	var p Profile
+	err := json.Unmarshal([]byte(`{"Name": "Alice", "DailyQuota": "2h", "WeeklyQuota": "10h30m"}`), &p)
+	if err != nil || p.DailyQuota != Duration(2*time.Hour) || p.WeeklyQuota != Duration(10*time.Hour+30*time.Minute) {
+		t.Errorf("json.Unmarshal() = %v, %v", p, err)
+	}
+	js, err := json.Marshal(p.DailyQuota)
+	if err != nil || string(js) != `"2h0m0s"` {
+		t.Errorf("json.Marshal(%v) = %s, %v", p.DailyQuota, js, err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	calendars, err := NewCalendars(calendarConfig, nil)
+	if err != nil {
+		t.Errorf("NewCalendars(%v) = %v", calendarConfig, err)
+		return
+	}
+	db := NewRAMDB()
+	err = db.Open()
+	if err != nil {
+		t.Errorf("db.Open() = %v", err)
+		return
+	}
+	defer testClose(t, db)
+	device := NewDevice("192.168.4.100", "Able")
+	device.Profile = "Alice"
+	err = db.Add(device)
+	if err != nil {
+		t.Errorf("db.Add(%v) = %v", device, err)
+		return
+	}
+	alice := NewProfile("Alice")
+	alice.DailyQuota = Duration(2 * time.Hour)
+	alice.WeeklyQuota = Duration(3 * time.Hour)
+	err = db.AddProfile(alice)
+	if err != nil {
+		t.Errorf("db.AddProfile(%v) = %v", alice, err)
+		return
+	}
+
+	location := calendars[""].(*timeClock).location
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2015, 3, day, hour, minute, 0, 0, location)
+	}
+	checkBlocked := func(label string, atTime time.Time, isBlocked bool, expectedGoodUntil time.Time) {
+		blocked, goodUntil, err := GetBlockList(db, calendars, atTime)
+		if err != nil || (len(blocked) == 1) != isBlocked || !goodUntil.Equal(expectedGoodUntil) {
+			t.Errorf("%s: GetBlockList(%v) = %v, %v, %v, expected blocked %v until %v",
+				label, atTime, blocked, goodUntil, err, isBlocked, expectedGoodUntil)
+		}
+	}
+	checkRemaining := func(label string, atTime time.Time, expected time.Duration) {
+		status, err := GetQuotaStatus(db, calendars, "Alice", atTime)
+		if err != nil || status.Remaining != Duration(expected) {
+			t.Errorf("%s: GetQuotaStatus(%v) = %v, %v, expected %v remaining",
+				label, atTime, status, err, expected)
+		}
+	}
+
+	// Tuesday. Quota profiles are blocked even when the calendar is on.
+	checkBlocked("before session", at(3, 16, 30), true, time.Time{})
+	err = StartQuotaSession(db, calendars, "Alice", at(3, 15, 0))
+	if err == nil {
+		t.Errorf("StartQuotaSession() outside of calendar succeeded")
+	}
+	err = StartQuotaSession(db, calendars, "Alice", at(3, 16, 0))
+	if err != nil {
+		t.Errorf("StartQuotaSession() = %v", err)
+		return
+	}
+	checkBlocked("in session", at(3, 16, 30), false, at(3, 18, 0))
+	checkRemaining("in session", at(3, 16, 30), 90*time.Minute)
+	err = StopQuotaSession(db, calendars, "Alice", at(3, 17, 0))
+	if err != nil {
+		t.Errorf("StopQuotaSession() = %v", err)
+		return
+	}
+	checkBlocked("after stop", at(3, 17, 0), true, time.Time{})
+	checkRemaining("after stop", at(3, 17, 30), time.Hour)
+
+	// A session ends when the calendar turns off.
+	err = StartQuotaSession(db, calendars, "Alice", at(3, 19, 30))
+	if err != nil {
+		t.Errorf("StartQuotaSession() = %v", err)
+		return
+	}
+	checkBlocked("late session", at(3, 19, 45), false, at(3, 20, 0))
+	checkBlocked("after late session", at(3, 20, 0), true, time.Time{})
+	checkRemaining("after late session", at(3, 21, 0), 30*time.Minute)
+
+	// Wednesday. The daily quota has reset, but only 1.5 hours are left
+	// this week.
+	checkRemaining("next day", at(4, 16, 0), 90*time.Minute)
+	err = StartQuotaSession(db, calendars, "Alice", at(4, 16, 0))
+	if err != nil {
+		t.Errorf("StartQuotaSession() = %v", err)
+		return
+	}
+	checkBlocked("next day", at(4, 16, 0), false, at(4, 17, 30))
+	checkRemaining("week used up", at(4, 18, 0), 0)
+	err = StartQuotaSession(db, calendars, "Alice", at(4, 18, 0))
+	if err == nil {
+		t.Errorf("StartQuotaSession() without quota succeeded")
+	}
+
+	// Sunday starts a new week.
+	checkRemaining("next week", at(8, 12, 0), 2*time.Hour)
+
+	// Grants still apply to quota profiles.
+	err = db.SetProfileActiveUntil("Alice", at(4, 19, 0))
+	if err != nil {
+		t.Errorf("db.SetProfileActiveUntil() = %v", err)
+		return
+	}
+	checkBlocked("granted", at(4, 18, 0), false, at(4, 19, 0))
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"fmt"
 	"sync"
 	"time"
 )
@@ -11,8 +12,11 @@ func NewRAMDB() (d DB) {
 }
 
 type ram struct {
-	mutex   sync.RWMutex
-	devices []Device
+	mutex             sync.RWMutex
+	devices           []Device
+	profiles          []Profile
+	timeRequests      []TimeRequest
+	nextTimeRequestID int
 }
 
 func (r *ram) Open() (err error) {
@@ -66,7 +70,8 @@ func (r *ram) find(ip DeviceIP) (i int) {
 func (r *ram) All() (devices []Device, err error) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
-	devices = r.devices[:]
+	// A copy, so that later changes don't show up while callers read it.
+	devices = append([]Device(nil), r.devices...)
 	return
 }
 
@@ -80,6 +85,19 @@ func (r *ram) SetActiveUntil(ip DeviceIP, activeUntil time.Time) (err error) {
 	return
 }
 
+func (r *ram) SetDeviceConfig(d Device) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.find(d.IP)
+	if i >= 0 {
+		device := &r.devices[i]
+		device.Name = d.Name
+		device.Calendar = d.Calendar
+		device.Profile = d.Profile
+	}
+	return
+}
+
 func (r *ram) ModifyActiveUntil(ip DeviceIP, delta time.Duration,
 	baseTime time.Time) (err error) {
 	r.mutex.Lock()
@@ -92,6 +110,161 @@ func (r *ram) ModifyActiveUntil(ip DeviceIP, delta time.Duration,
 	return
 }
 
+func (r *ram) AddProfile(p Profile) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// A second profile with the same name would never be found.
+	if r.findProfile(p.Name) >= 0 {
+		err = fmt.Errorf("Profile %q already exists", p.Name)
+		return
+	}
+	r.profiles = append(r.profiles, p)
+	return
+}
+
+func (r *ram) RemoveProfile(name string) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.findProfile(name)
+	if i >= 0 {
+		r.profiles = append(r.profiles[:i], r.profiles[i+1:]...)
+	}
+	return
+}
+
+func (r *ram) FindProfile(name string) (profile Profile, found bool, err error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	index := r.findProfile(name)
+	found = index >= 0
+	if found {
+		profile = r.profiles[index]
+	}
+	return
+}
+
+func (r *ram) findProfile(name string) (i int) {
+	for i, p := range r.profiles {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *ram) AllProfiles() (profiles []Profile, err error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	// A copy, so that later changes don't show up while callers read it.
+	profiles = append([]Profile(nil), r.profiles...)
+	return
+}
+
+func (r *ram) SetProfileActiveUntil(name string, activeUntil time.Time) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.findProfile(name)
+	if i >= 0 {
+		r.profiles[i].ActiveUntil = activeUntil
+	}
+	return
+}
+
+func (r *ram) ModifyProfileActiveUntil(name string, delta time.Duration,
+	baseTime time.Time) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.findProfile(name)
+	if i >= 0 {
+		p := &r.profiles[i]
+		p.ActiveUntil = modifyActiveUntil(p.ActiveUntil, delta, baseTime)
+	}
+	return
+}
+
+func (r *ram) SetProfileQuotaUsage(name string, usage QuotaUsage) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.findProfile(name)
+	if i >= 0 {
+		r.profiles[i].QuotaUsage = usage
+	}
+	return
+}
+
+func (r *ram) SetProfileConfig(p Profile) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.findProfile(p.Name)
+	if i >= 0 {
+		profile := &r.profiles[i]
+		profile.Calendar = p.Calendar
+		profile.DailyQuota = p.DailyQuota
+		profile.WeeklyQuota = p.WeeklyQuota
+	}
+	return
+}
+
+func (r *ram) AddTimeRequest(request TimeRequest) (id int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.nextTimeRequestID++
+	id = r.nextTimeRequestID
+	request.ID = id
+	r.timeRequests = append(r.timeRequests, request)
+	return
+}
+
+func (r *ram) RemoveTimeRequest(id int) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.findTimeRequest(id)
+	if i >= 0 {
+		r.timeRequests = append(r.timeRequests[:i], r.timeRequests[i+1:]...)
+	}
+	return
+}
+
+func (r *ram) FindTimeRequest(id int) (request TimeRequest, found bool, err error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	index := r.findTimeRequest(id)
+	found = index >= 0
+	if found {
+		request = r.timeRequests[index]
+	}
+	return
+}
+
+func (r *ram) findTimeRequest(id int) (i int) {
+	for i, request := range r.timeRequests {
+		if request.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *ram) AllTimeRequests() (requests []TimeRequest, err error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	// A copy, so callers can remove requests while looking through them.
+	requests = append([]TimeRequest(nil), r.timeRequests...)
+	return
+}
+
+func (r *ram) SetTimeRequestStatus(id int, status TimeRequestStatus,
+	answered time.Time) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.findTimeRequest(id)
+	if i >= 0 {
+		r.timeRequests[i].Status = status
+		r.timeRequests[i].Answered = answered
+	}
+	return
+}
+
 func (r *ram) Close() (err error) {
 	return
 }
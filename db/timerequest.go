@@ -0,0 +1,97 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+type TimeRequestStatus string
+
+const (
+	TimeRequestPending  TimeRequestStatus = "pending"
+	TimeRequestApproved TimeRequestStatus = "approved"
+	TimeRequestDenied   TimeRequestStatus = "denied"
+	TimeRequestExpired  TimeRequestStatus = "expired"
+)
+
+// A request for more Internet time for a device, which waits for a parent to
+// approve or deny it.
+type TimeRequest struct {
+	ID       int
+	IP       DeviceIP
+	Duration Duration
+	Created  time.Time
+	Status   TimeRequestStatus
+	Answered time.Time // When the request was approved, denied or expired.
+}
+
+func NewTimeRequest(ip DeviceIP, duration time.Duration, created time.Time) TimeRequest {
+	return TimeRequest{0, ip, Duration(duration), created, TimeRequestPending, time.Time{}}
+}
+
+// How long answered requests are kept, so that they can be seen in the UI.
+const TimeRequestHistory = 24 * time.Hour
+
+// Marks pending requests older than timeout as expired, and forgets requests
+// that were answered more than TimeRequestHistory ago.
+func ExpireTimeRequests(db DB, now time.Time, timeout time.Duration) (err error) {
+	requests, err := db.AllTimeRequests()
+	if err != nil {
+		return
+	}
+	for _, r := range requests {
+		expires := r.Created.Add(timeout)
+		if r.Status == TimeRequestPending && !now.Before(expires) {
+			err = db.SetTimeRequestStatus(r.ID, TimeRequestExpired, expires)
+		} else if r.Status != TimeRequestPending && now.Sub(r.Answered) > TimeRequestHistory {
+			err = db.RemoveTimeRequest(r.ID)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Approve or deny a pending request. Approving it gives the device the
+// requested time before the request is marked approved, so that a request
+// that failed to be answered is still pending. Returns the request as it was
+// before it was answered.
+func AnswerTimeRequest(db DB, id int, approve bool, now time.Time) (request TimeRequest, err error) {
+	request, found, err := db.FindTimeRequest(id)
+	if err != nil {
+		return
+	}
+	if !found {
+		err = fmt.Errorf("Unknown time request %d", id)
+		return
+	}
+	if request.Status != TimeRequestPending {
+		err = fmt.Errorf("Time request %d is already %s", id, request.Status)
+		return
+	}
+	status := TimeRequestDenied
+	var device Device
+	var granted bool
+	if approve {
+		status = TimeRequestApproved
+		device, granted, err = db.Find(request.IP)
+		if err != nil {
+			return
+		}
+		err = db.ModifyActiveUntil(request.IP, time.Duration(request.Duration), now)
+		if err != nil {
+			return
+		}
+	}
+	err = db.SetTimeRequestStatus(id, status, now)
+	if err != nil && granted {
+		// Take the time back, since the request can be answered again.
+		if undoErr := db.SetActiveUntil(request.IP, device.ActiveUntil); undoErr != nil {
+			err = fmt.Errorf("%v, and could not take the time back: %v", err, undoErr)
+		}
+	}
+	return
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTimeRequests(t *testing.T) {
+	db := NewRAMDB()
+	err := db.Open()
+	if err != nil {
+		t.Errorf("db.Open() = %v", err)
+		return
+	}
+	defer testClose(t, db)
+	ip := ParseDeviceIP("192.168.1.201")
+	start := time.Date(2015, 3, 3, 16, 0, 0, 0, time.UTC)
+	timeout := 30 * time.Minute
+	var ids []int
+	for i := 0; i < 3; i++ {
+		var id int
+		id, err = db.AddTimeRequest(NewTimeRequest(ip, time.Hour, start.Add(time.Duration(i)*time.Hour)))
+		if err != nil {
+			t.Errorf("db.AddTimeRequest() = %v", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	checkStatus := func(label string, id int, expected TimeRequestStatus) {
+		request, found, err := db.FindTimeRequest(id)
+		if err != nil || !found || request.Status != expected {
+			t.Errorf("%s: db.FindTimeRequest(%d) = %v, %v, %v, expected %s",
+				label, id, request, found, err, expected)
+		}
+	}
+
+	now := start.Add(20 * time.Minute)
+	request, err := AnswerTimeRequest(db, ids[0], true, now)
+	if err != nil || request.Duration != Duration(time.Hour) {
+		t.Errorf("AnswerTimeRequest(%d) = %v, %v", ids[0], request, err)
+	}
+	checkStatus("approved", ids[0], TimeRequestApproved)
+	_, err = AnswerTimeRequest(db, ids[0], false, now)
+	if err == nil {
+		t.Errorf("AnswerTimeRequest() of an answered request succeeded")
+	}
+	_, err = AnswerTimeRequest(db, 1000, true, now)
+	if err == nil {
+		t.Errorf("AnswerTimeRequest() of an unknown request succeeded")
+	}
+
+	// The second request was made at 5PM and expires at 5:30PM.
+	now = start.Add(90 * time.Minute)
+	err = ExpireTimeRequests(db, now, timeout)
+	if err != nil {
+		t.Errorf("ExpireTimeRequests(%v) = %v", now, err)
+	}
+	checkStatus("expired", ids[1], TimeRequestExpired)
+	checkStatus("not expired", ids[2], TimeRequestPending)
+	_, err = AnswerTimeRequest(db, ids[1], true, now)
+	if err == nil {
+		t.Errorf("AnswerTimeRequest() of an expired request succeeded")
+	}
+
+	// Answered requests are forgotten after a day.
+	now = start.Add(TimeRequestHistory + time.Hour)
+	err = ExpireTimeRequests(db, now, timeout)
+	if err != nil {
+		t.Errorf("ExpireTimeRequests(%v) = %v", now, err)
+	}
+	requests, err := db.AllTimeRequests()
+	if err != nil || len(requests) != 2 || requests[0].ID != ids[1] || requests[1].ID != ids[2] {
+		t.Errorf("db.AllTimeRequests() = %v, %v", requests, err)
+	}
+}
+
+// A DB whose changes can be made to fail, as if they could not be saved.
+type failingDB struct {
+	DB
+	failModify bool
+	failStatus bool
+}
+
+func (f *failingDB) ModifyActiveUntil(ip DeviceIP, delta time.Duration, baseTime time.Time) (err error) {
+	if f.failModify {
+		return fmt.Errorf("disk full")
+	}
+	return f.DB.ModifyActiveUntil(ip, delta, baseTime)
+}
+
+func (f *failingDB) SetTimeRequestStatus(id int, status TimeRequestStatus, answered time.Time) (err error) {
+	if f.failStatus {
+		return fmt.Errorf("disk full")
+	}
+	return f.DB.SetTimeRequestStatus(id, status, answered)
+}
+
+func TestAnswerTimeRequestFails(t *testing.T) {
+	db := &failingDB{DB: NewRAMDB()}
+	ip := ParseDeviceIP("192.168.1.201")
+	err := db.Add(NewDevice("192.168.1.201", "laptop"))
+	if err != nil {
+		t.Fatalf("db.Add() = %v", err)
+	}
+	now := time.Date(2015, 3, 3, 16, 0, 0, 0, time.UTC)
+	id, err := db.AddTimeRequest(NewTimeRequest(ip, time.Hour, now))
+	if err != nil {
+		t.Fatalf("db.AddTimeRequest() = %v", err)
+	}
+	check := func(label string, expectedStatus TimeRequestStatus, expectedActiveUntil time.Time) {
+		request, _, _ := db.FindTimeRequest(id)
+		device, _, _ := db.Find(ip)
+		if request.Status != expectedStatus || !device.ActiveUntil.Equal(expectedActiveUntil) {
+			t.Errorf("%s: the request is %s and the device is active until %v, expected %s and %v",
+				label, request.Status, device.ActiveUntil, expectedStatus, expectedActiveUntil)
+		}
+	}
+
+	db.failModify = true
+	_, err = AnswerTimeRequest(db, id, true, now)
+	if err == nil {
+		t.Errorf("AnswerTimeRequest() succeeded although the time could not be granted")
+	}
+	check("grant failed", TimeRequestPending, time.Time{})
+
+	db.failModify = false
+	db.failStatus = true
+	_, err = AnswerTimeRequest(db, id, true, now)
+	if err == nil {
+		t.Errorf("AnswerTimeRequest() succeeded although the answer could not be saved")
+	}
+	check("answer failed", TimeRequestPending, time.Time{})
+
+	db.failStatus = false
+	_, err = AnswerTimeRequest(db, id, true, now)
+	if err != nil {
+		t.Errorf("AnswerTimeRequest() = %v", err)
+	}
+	check("approved", TimeRequestApproved, now.Add(time.Hour))
+}
@@ -49,7 +49,7 @@ type DeviceConfigEntry struct {
 
 func NewDeviceConfigEntryFromCSV(csv []string) (*DeviceConfigEntry, error) {
 	if len(csv) != 11 {
-		return nil, fmt.Errorf("Expected 11 fields:", csv)
+		return nil, fmt.Errorf("Expected 11 fields: %q", csv)
 	}
 	return &DeviceConfigEntry{csv[0], csv[1], csv[2], csv[3], csv[4], csv[5], csv[6],
 		csv[7], csv[8], csv[9], csv[10]}, nil
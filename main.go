@@ -3,6 +3,8 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,56 +13,286 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
 	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/jackpal/SeattleSnowman/auth"
+	"github.com/jackpal/SeattleSnowman/clock"
 	"github.com/jackpal/SeattleSnowman/db"
 	"github.com/jackpal/SeattleSnowman/router"
 	"github.com/jackpal/SeattleSnowman/watcher"
 )
 
-type Configuration struct {
-	Port                 int    // Port to serve from.
-	AddressGroup         string // Router Filter address group.
-	RouterAddress        string // Router ssh address (name:port, port is optional);
+// How to reach a router.
+type RouterConfig struct {
+	Name                 string // Names the router in logs and status, when it is one of Routers.
+	RouterType           string // "edgerouter" (the default), "edgeosapi", "openwrt", "routeros", "opnsense", "pfsense", "nftables" or "dryrun".
+	RouterAddress        string // Router ssh or API address (name:port, port is optional, defaults to 22, or 8728/8729 for RouterOS), or URL for web APIs;
+	RouterUser           string // Router ssh or API user. Defaults to "ubnt", "root" for OpenWrt, or "admin" for RouterOS.
+	RouterPassword       string // Router ssh password, if the router allows password logins, or API password.
 	RouterPrivateKeyPath string // Router ssh private key file.
-	Calendar             db.CalendarConfig
-	Devices              []db.Device
+	RouterKeyPassphrase  string // Passphrase of RouterPrivateKeyPath, if it is encrypted.
+	RouterUseSSHAgent    bool   // Log in to the router with the keys of the ssh-agent at $SSH_AUTH_SOCK.
+	RouterKnownHostsPath string // Router ssh host keys. Defaults to ~/.ssh/known_hosts.
+	RouterPinHostKey     bool   // Trust the router's host key the first time, and add it to RouterKnownHostsPath.
+	RouterUseTLS         bool   // Use the RouterOS api-ssl service instead of the plain api service.
+	RouterCACertPath     string // PEM certificate to trust for the router's TLS certificate. Defaults to the system's CAs.
+	RouterAPIKey         string // OPNsense or pfSense API key.
+	RouterAPISecret      string // OPNsense API secret.
+	OpenWrtMode          string // "nft" (the default) to manage an nftables set, or "uci" for a firewall ipset.
+	NFTablesFamily       string // nftables family of the address group set. Defaults to "inet".
+	NFTablesTable        string // nftables table of the address group set. Defaults to "filter", or "fw4" for OpenWrt.
+}
+
+type Configuration struct {
+	Port                int            // Port to serve from.
+	AddressGroup        string         // Router Filter address group.
+	RouterConfig                       // The router, unless Routers is set.
+	Routers             []RouterConfig // Several routers that all enforce the blocks, like a main router and a mesh access point.
+	RouterFailurePolicy string         // Which of Routers must accept a change: "all" (the default), "first" or "any".
+	DatabasePath        string         // Database file. If empty, nothing is saved across restarts.
+	ShutdownPolicy      string         // Address group on exit: "block", "leave" or "calendar" (the default).
+	Calendar            db.CalendarConfig
+	Calendars           map[string]db.CalendarConfig // Named calendars that devices may use.
+	TimeRequestTimeout  db.Duration                  // How long requests for more time wait for an answer. Defaults to 1h.
+	ReconcileInterval   *db.Duration                 // How often to check the router for drift. Defaults to 5m, 0 turns it off.
+	Profiles            []db.Profile
+	Devices             []db.Device
+	Users               []auth.User // Who may use the web UI. If empty, anyone may do anything.
+	AnonymousRole       auth.Role   // Role of requests without credentials. Defaults to "none".
 }
 
 var configFile = flag.String("config", "config.json", "Configuration file.")
+var dryRun = flag.Bool("dry-run", false,
+	"Keep the address group in memory instead of changing the router, as if RouterType were \"dryrun\".")
+var hashPassword = flag.Bool("hashPassword", false,
+	"Read a password from standard input, print its hash for the Users configuration, and exit.")
 
 var watch *watcher.Watcher
 
+// The firewall, if RouterType is "dryrun".
+var dryRunFirewall *router.DryRunFirewall
+
+// How long to wait for HTTP requests to finish when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// The source of time for the watcher and the handlers. Tests may replace it.
+var systemClock = clock.New()
+
+func newDB(config *Configuration) db.DB {
+	if config.DatabasePath == "" {
+		return db.NewRAMDB()
+	}
+	return db.NewFileDB(config.DatabasePath)
+}
+
 func newWatcher(config *Configuration) (w *watcher.Watcher, err error) {
-	database := db.NewRAMDB()
+	database := newDB(config)
 	err = database.Open()
 	if err != nil {
 		return
 	}
-	err = maybeAddDevices(database, config.Devices)
+	calendars, err := db.NewCalendars(&config.Calendar, config.Calendars)
+	if err != nil {
+		return
+	}
+	err = maybeAddProfiles(database, calendars, config.Profiles)
+	if err != nil {
+		return
+	}
+	err = maybeAddDevices(database, calendars, config.Devices)
+	if err != nil {
+		return
+	}
+	firewall, err := newFirewall(config)
 	if err != nil {
 		return
 	}
-	calendar, err := db.NewCalendar(&config.Calendar)
+	w = watcher.NewWatcher(database, calendars, firewall, config.AddressGroup, systemClock)
+	if config.TimeRequestTimeout > 0 {
+		w.SetTimeRequestTimeout(time.Duration(config.TimeRequestTimeout))
+	}
+	if config.ReconcileInterval != nil {
+		w.SetReconcileInterval(time.Duration(*config.ReconcileInterval))
+	}
+	return
+}
+
+func sshConfig(config *RouterConfig) router.SSHConfig {
+	return router.SSHConfig{
+		Address:        config.RouterAddress,
+		User:           config.RouterUser,
+		Password:       config.RouterPassword,
+		PrivateKeyPath: config.RouterPrivateKeyPath,
+		Passphrase:     config.RouterKeyPassphrase,
+		UseAgent:       config.RouterUseSSHAgent,
+		KnownHostsPath: config.RouterKnownHostsPath,
+		PinHostKey:     config.RouterPinHostKey,
+	}
+}
+
+func restConfig(config *RouterConfig) router.RESTConfig {
+	return router.RESTConfig{
+		Address:    config.RouterAddress,
+		APIKey:     config.RouterAPIKey,
+		APISecret:  config.RouterAPISecret,
+		User:       config.RouterUser,
+		Password:   config.RouterPassword,
+		CACertPath: config.RouterCACertPath,
+	}
+}
+
+// Returns the configured nftables family and table, or the defaults.
+func nftablesSet(config *RouterConfig, defaultTable string) (family string, table string) {
+	family = config.NFTablesFamily
+	if family == "" {
+		family = "inet"
+	}
+	table = config.NFTablesTable
+	if table == "" {
+		table = defaultTable
+	}
+	return
+}
+
+// Returns the router's firewall, or a MultiFirewall if there are several
+// routers.
+func newFirewall(config *Configuration) (firewall router.Firewall, err error) {
+	if len(config.Routers) == 0 {
+		return newRouterFirewall(&config.RouterConfig)
+	}
+	policy, err := router.ParsePartialFailurePolicy(config.RouterFailurePolicy)
 	if err != nil {
 		return
 	}
-	firewall := router.NewEdgeRouterFirewall(config.RouterAddress, config.RouterPrivateKeyPath)
-	w = watcher.NewWatcher(database, calendar, firewall, config.AddressGroup)
+	var firewalls []router.NamedFirewall
+	dryRuns := 0
+	for i := range config.Routers {
+		routerConfig := &config.Routers[i]
+		name := routerConfig.Name
+		if name == "" {
+			name = fmt.Sprintf("router %d", i+1)
+		}
+		// There is only one dry run history.
+		if routerConfig.RouterType == "dryrun" {
+			dryRuns++
+			if dryRuns > 1 {
+				err = fmt.Errorf("Router %q: only one of Routers may be \"dryrun\"", name)
+				return
+			}
+		}
+		var f router.Firewall
+		f, err = newRouterFirewall(routerConfig)
+		if err != nil {
+			err = fmt.Errorf("Router %q: %v", name, err)
+			return
+		}
+		firewalls = append(firewalls, router.NamedFirewall{Name: name, Firewall: f})
+	}
+	firewall = router.NewMultiFirewall(firewalls, policy, systemClock)
+	return
+}
+
+func newRouterFirewall(config *RouterConfig) (firewall router.Firewall, err error) {
+	switch config.RouterType {
+	case "", "edgerouter":
+		firewall = router.NewEdgeRouterFirewall(sshConfig(config))
+	case "edgeosapi":
+		firewall, err = router.NewEdgeOSAPIFirewall(restConfig(config))
+	case "openwrt":
+		switch config.OpenWrtMode {
+		case "", "nft":
+			family, table := nftablesSet(config, "fw4")
+			firewall = router.NewOpenWrtNFTablesFirewall(sshConfig(config), family, table)
+		case "uci":
+			firewall = router.NewOpenWrtUCIFirewall(sshConfig(config))
+		default:
+			err = fmt.Errorf("Unknown OpenWrtMode %q", config.OpenWrtMode)
+		}
+	case "routeros":
+		firewall = router.NewRouterOSFirewall(router.RouterOSConfig{
+			Address:    config.RouterAddress,
+			User:       config.RouterUser,
+			Password:   config.RouterPassword,
+			UseTLS:     config.RouterUseTLS,
+			CACertPath: config.RouterCACertPath,
+		})
+	case "opnsense":
+		firewall, err = router.NewOPNsenseFirewall(restConfig(config))
+	case "pfsense":
+		firewall, err = router.NewPfSenseFirewall(restConfig(config))
+	case "nftables":
+		family, table := nftablesSet(config, "filter")
+		firewall = router.NewNFTablesFirewall(family, table, router.NewExecRunner())
+	case "dryrun":
+		log.Printf("Dry run: the router will not be changed")
+		dryRunFirewall = router.NewDryRunFirewall(systemClock)
+		firewall = dryRunFirewall
+	default:
+		err = fmt.Errorf("Unknown RouterType %q", config.RouterType)
+	}
+	return
+}
+
+// Adds the configured profiles that are missing from the database, and updates
+// the ones that have changed.
+func maybeAddProfiles(database db.DB, calendars db.Calendars, profiles []db.Profile) (err error) {
+	for _, profile := range profiles {
+		err = calendars.Check(profile.Calendar)
+		if err != nil {
+			err = fmt.Errorf("Profile %q: %v", profile.Name, err)
+			return
+		}
+		var existing db.Profile
+		var found bool
+		existing, found, err = database.FindProfile(profile.Name)
+		if err != nil {
+			return
+		}
+		if !found {
+			err = database.AddProfile(profile)
+		} else if existing.Calendar != profile.Calendar || existing.DailyQuota != profile.DailyQuota ||
+			existing.WeeklyQuota != profile.WeeklyQuota {
+			// The configuration wins over the database, except for granted
+			// time and quota usage.
+			log.Printf("Updating profile %q from the configuration", profile.Name)
+			err = database.SetProfileConfig(profile)
+		}
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
-func maybeAddDevices(db db.DB, devices []db.Device) (err error) {
+// Adds the configured devices that are missing from the database, and updates
+// the ones that have changed.
+func maybeAddDevices(database db.DB, calendars db.Calendars, devices []db.Device) (err error) {
 	for _, device := range devices {
+		err = calendars.Check(device.Calendar)
+		if err != nil {
+			err = fmt.Errorf("Device %s: %v", device.IP, err)
+			return
+		}
+		var existing db.Device
 		var found bool
-		_, found, err = db.Find(device.IP)
+		existing, found, err = database.Find(device.IP)
 		if err != nil {
 			return
 		}
 		if !found {
-			err = db.Add(device)
+			err = database.Add(device)
+		} else if existing.Name != device.Name || existing.Calendar != device.Calendar ||
+			existing.Profile != device.Profile {
+			// The configuration wins over the database, except for granted time.
+			log.Printf("Updating device %s from the configuration", device.IP)
+			err = database.SetDeviceConfig(device)
 		}
 		if err != nil {
 			return
@@ -69,6 +301,42 @@ func maybeAddDevices(db db.DB, devices []db.Device) (err error) {
 	return
 }
 
+func newAuthenticator(config *Configuration) (a *auth.Authenticator, err error) {
+	if len(config.Users) == 0 {
+		log.Printf("No Users are configured, so anyone can change settings.")
+		return auth.NewAuthenticator(nil, auth.AdminRole)
+	}
+	return auth.NewAuthenticator(config.Users, config.AnonymousRole)
+}
+
+// Serves the static files. The admin console is only for admins.
+func newStaticHandler(a *auth.Authenticator) http.Handler {
+	fs := http.FileServer(http.Dir("static"))
+	admin := a.Require(auth.AdminRole, fs)
+	read := a.Require(auth.ReadRole, fs)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Clean(r.URL.Path) == "/admin.html" {
+			admin.ServeHTTP(w, r)
+		} else {
+			read.ServeHTTP(w, r)
+		}
+	})
+}
+
+func printPasswordHash() (err error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return
+	}
+	hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return
+	}
+	fmt.Println(hash)
+	return
+}
+
 func writeJSON(w http.ResponseWriter, jsonData interface{}, err error) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -84,12 +352,32 @@ func writeJSON(w http.ResponseWriter, jsonData interface{}, err error) {
 	w.Write(js)
 }
 
-func handleDeviceListImp(r *http.Request) (state []db.Device, err error) {
+// A device, and the quota of its profile if it has one.
+type deviceListEntry struct {
+	db.Device
+	Quota *db.QuotaStatus `json:",omitempty"`
+}
+
+func handleDeviceListImp(r *http.Request) (state []deviceListEntry, err error) {
 	if r.Method != "GET" {
 		err = fmt.Errorf("Method != GET")
 		return
 	}
-	state, err = watch.State()
+	devices, err := watch.State()
+	if err != nil {
+		return
+	}
+	quotas, err := watch.QuotaStatus()
+	if err != nil {
+		return
+	}
+	for _, d := range devices {
+		entry := deviceListEntry{d, nil}
+		if quota, ok := quotas[d.Profile]; ok && d.Profile != "" {
+			entry.Quota = &quota
+		}
+		state = append(state, entry)
+	}
 	return
 }
 
@@ -128,6 +416,38 @@ func handleBlockList(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, a, err)
 }
 
+func handleRouterStatusImp(r *http.Request) (health watcher.RouterHealth, err error) {
+	if r.Method != "GET" {
+		err = fmt.Errorf("Method != GET")
+		return
+	}
+	health = watch.RouterHealth()
+	return
+}
+
+func handleRouterStatus(w http.ResponseWriter, r *http.Request) {
+	health, err := handleRouterStatusImp(r)
+	writeJSON(w, health, err)
+}
+
+func handleDryRunHistoryImp(r *http.Request) (history []router.DryRunChange, err error) {
+	if r.Method != "GET" {
+		err = fmt.Errorf("Method != GET")
+		return
+	}
+	if dryRunFirewall == nil {
+		err = fmt.Errorf("Not a dry run")
+		return
+	}
+	history = dryRunFirewall.History()
+	return
+}
+
+func handleDryRunHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := handleDryRunHistoryImp(r)
+	writeJSON(w, history, err)
+}
+
 func handleAddDevice(w http.ResponseWriter, r *http.Request) {
 	err := addDeviceImp(r)
 	writeJSON(w, nil, err)
@@ -140,10 +460,99 @@ func addDeviceImp(r *http.Request) (err error) {
 	}
 	ip := r.FormValue("ip")
 	name := r.FormValue("name")
-	err = watch.AddDevice(db.NewDevice(ip, name))
+	device := db.NewDevice(ip, name)
+	device.Calendar = r.FormValue("calendar")
+	device.Profile = r.FormValue("profile")
+	err = watch.AddDevice(device)
+	return
+}
+
+func handleProfileListImp(r *http.Request) (profiles []db.Profile, err error) {
+	if r.Method != "GET" {
+		err = fmt.Errorf("Method != GET")
+		return
+	}
+	profiles, err = watch.Profiles()
+	return
+}
+
+func handleProfileList(w http.ResponseWriter, r *http.Request) {
+	profiles, err := handleProfileListImp(r)
+	writeJSON(w, profiles, err)
+}
+
+func handleAddProfile(w http.ResponseWriter, r *http.Request) {
+	err := addProfileImp(r)
+	writeJSON(w, nil, err)
+}
+
+func addProfileImp(r *http.Request) (err error) {
+	if r.Method != "POST" {
+		err = fmt.Errorf("Method != POST")
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		err = fmt.Errorf("Missing name parameter")
+		return
+	}
+	profile := db.NewProfile(name)
+	profile.Calendar = r.FormValue("calendar")
+	err = watch.AddProfile(profile)
 	return
 }
 
+func modifyProfileActiveUntilImp(r *http.Request) (err error) {
+	if r.Method != "POST" {
+		err = fmt.Errorf("Must use POST")
+		return
+	}
+	name := r.FormValue("profile")
+	if name == "" {
+		err = fmt.Errorf("Missing profile parameter")
+		return
+	}
+	delta, err := time.ParseDuration(r.FormValue("delta"))
+	if err != nil {
+		return
+	}
+	err = watch.ModifyProfileActiveUntil(name, delta)
+	return
+}
+
+func handleModifyProfileActiveUntil(w http.ResponseWriter, r *http.Request) {
+	err := modifyProfileActiveUntilImp(r)
+	writeJSON(w, nil, err)
+}
+
+func quotaSessionImp(r *http.Request, start bool) (err error) {
+	if r.Method != "POST" {
+		err = fmt.Errorf("Must use POST")
+		return
+	}
+	name := r.FormValue("profile")
+	if name == "" {
+		err = fmt.Errorf("Missing profile parameter")
+		return
+	}
+	if start {
+		err = watch.StartQuotaSession(name)
+	} else {
+		err = watch.StopQuotaSession(name)
+	}
+	return
+}
+
+func handleStartQuota(w http.ResponseWriter, r *http.Request) {
+	err := quotaSessionImp(r, true)
+	writeJSON(w, nil, err)
+}
+
+func handleStopQuota(w http.ResponseWriter, r *http.Request) {
+	err := quotaSessionImp(r, false)
+	writeJSON(w, nil, err)
+}
+
 func handleBlock(w http.ResponseWriter, r *http.Request) {
 	err := setActiveUntilImp(r, time.Time{})
 	writeJSON(w, nil, err)
@@ -164,7 +573,7 @@ func handleUnblockImp(r *http.Request) (err error) {
 	if err != nil {
 		return
 	}
-	blockTime := time.Now().Add(time.Duration(hoursInt) * time.Hour)
+	blockTime := systemClock.Now().Add(time.Duration(hoursInt) * time.Hour)
 	err = setActiveUntilImp(r, blockTime)
 	return
 }
@@ -210,6 +619,77 @@ func setActiveUntilImp(r *http.Request, activeUntil time.Time) (err error) {
 	return
 }
 
+// Asks for more time for a device. The device defaults to the one making the
+// request, so that kids can ask from their own devices.
+func requestTimeImp(r *http.Request) (request db.TimeRequest, err error) {
+	if r.Method != "POST" {
+		err = fmt.Errorf("Must use POST")
+		return
+	}
+	ip := r.FormValue("ip")
+	if ip == "" {
+		ip, _, err = net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return
+		}
+	}
+	deviceIP := db.ParseDeviceIP(ip)
+	if deviceIP == nil {
+		err = fmt.Errorf("Could not parse IP value %q", ip)
+		return
+	}
+	duration := time.Hour
+	if d := r.FormValue("duration"); d != "" {
+		duration, err = time.ParseDuration(d)
+		if err != nil {
+			return
+		}
+	}
+	request, err = watch.RequestTime(deviceIP, duration)
+	return
+}
+
+func handleRequestTime(w http.ResponseWriter, r *http.Request) {
+	request, err := requestTimeImp(r)
+	writeJSON(w, request, err)
+}
+
+func handleTimeRequestListImp(r *http.Request) (requests []db.TimeRequest, err error) {
+	if r.Method != "GET" {
+		err = fmt.Errorf("Method != GET")
+		return
+	}
+	requests, err = watch.TimeRequests()
+	return
+}
+
+func handleTimeRequestList(w http.ResponseWriter, r *http.Request) {
+	requests, err := handleTimeRequestListImp(r)
+	writeJSON(w, requests, err)
+}
+
+func answerTimeRequestImp(r *http.Request) (err error) {
+	if r.Method != "POST" {
+		err = fmt.Errorf("Must use POST")
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return
+	}
+	approve, err := strconv.ParseBool(r.FormValue("approve"))
+	if err != nil {
+		return
+	}
+	err = watch.AnswerTimeRequest(id, approve)
+	return
+}
+
+func handleAnswerTimeRequest(w http.ResponseWriter, r *http.Request) {
+	err := answerTimeRequestImp(r)
+	writeJSON(w, nil, err)
+}
+
 func handleUploadDevices(w http.ResponseWriter, r *http.Request) {
 	err := uploadDevicesImp(r)
 	writeJSON(w, nil, err)
@@ -229,7 +709,11 @@ func uploadDevicesImp(r *http.Request) (err error) {
 	if err != nil {
 		return
 	}
-	dbDevices, err := deviceConfigToDevices(devices)
+	dbDevices, profiles, err := deviceConfigToDevices(devices)
+	if err != nil {
+		return
+	}
+	err = watch.AddProfiles(profiles)
 	if err != nil {
 		return
 	}
@@ -237,13 +721,20 @@ func uploadDevicesImp(r *http.Request) (err error) {
 	return
 }
 
-func deviceConfigToDevices(dces []*DeviceConfigEntry) (devices []db.Device, err error) {
+// Kids' devices are managed. Each owner of a managed device gets a profile.
+func deviceConfigToDevices(dces []*DeviceConfigEntry) (devices []db.Device, profiles []db.Profile, err error) {
+	owners := make(map[string]bool)
 	for _, dce := range dces {
 		if dce.Kids == "" {
 			continue
 		}
 		d := db.NewDevice(dce.IP, dce.Name)
+		d.Profile = dce.Owner
 		devices = append(devices, d)
+		if dce.Owner != "" && !owners[dce.Owner] {
+			owners[dce.Owner] = true
+			profiles = append(profiles, db.NewProfile(dce.Owner))
+		}
 	}
 	return
 }
@@ -270,6 +761,68 @@ func (a byName) Len() int           { return len(a) }
 func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
 
+// A profile and its devices, as shown on the devices page.
+type profileDevices struct {
+	db.Profile
+	Devices []db.Device
+	Quota   *db.QuotaStatus
+}
+
+// A pending time request, as shown on the devices page.
+type pendingTimeRequest struct {
+	db.TimeRequest
+	Name string // The device's name.
+}
+
+type devicesPage struct {
+	Router       watcher.RouterHealth
+	TimeRequests []pendingTimeRequest
+	Profiles     []profileDevices
+	Devices      []db.Device // Devices that don't belong to a profile.
+}
+
+// Sort by profile name.
+type byProfileName []profileDevices
+
+func (a byProfileName) Len() int           { return len(a) }
+func (a byProfileName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byProfileName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+func newDevicesPage(profiles []db.Profile, devices []db.Device,
+	quotas map[string]db.QuotaStatus, requests []db.TimeRequest) (page devicesPage) {
+	sort.Sort(byName(devices))
+	for _, r := range requests {
+		if r.Status != db.TimeRequestPending {
+			continue
+		}
+		entry := pendingTimeRequest{r, r.IP.String()}
+		for _, d := range devices {
+			if d.IP.Equal(r.IP) {
+				entry.Name = d.Name
+			}
+		}
+		page.TimeRequests = append(page.TimeRequests, entry)
+	}
+	index := make(map[string]int)
+	for _, p := range profiles {
+		index[p.Name] = len(page.Profiles)
+		entry := profileDevices{p, nil, nil}
+		if quota, ok := quotas[p.Name]; ok {
+			entry.Quota = &quota
+		}
+		page.Profiles = append(page.Profiles, entry)
+	}
+	for _, d := range devices {
+		if i, ok := index[d.Profile]; ok && d.Profile != "" {
+			page.Profiles[i].Devices = append(page.Profiles[i].Devices, d)
+		} else {
+			page.Devices = append(page.Devices, d)
+		}
+	}
+	sort.Sort(byProfileName(page.Profiles))
+	return
+}
+
 func handleDevicesImp(w http.ResponseWriter, r *http.Request) (err error) {
 	funcMap := template.FuncMap{
 		"timeIsZero": timeIsZero,
@@ -284,8 +837,21 @@ func handleDevicesImp(w http.ResponseWriter, r *http.Request) (err error) {
 	if err != nil {
 		return
 	}
-	sort.Sort(byName(devices))
-	err = tmpl.Execute(w, devices)
+	profiles, err := watch.Profiles()
+	if err != nil {
+		return
+	}
+	quotas, err := watch.QuotaStatus()
+	if err != nil {
+		return
+	}
+	requests, err := watch.TimeRequests()
+	if err != nil {
+		return
+	}
+	page := newDevicesPage(profiles, devices, quotas, requests)
+	page.Router = watch.RouterHealth()
+	err = tmpl.Execute(w, page)
 	return
 }
 
@@ -298,6 +864,37 @@ func main() {
 	}
 }
 
+// Returns a copy of the router configuration without its secrets, for logs.
+func (c RouterConfig) redacted() RouterConfig {
+	for _, secret := range []*string{&c.RouterPassword, &c.RouterKeyPassphrase,
+		&c.RouterAPIKey, &c.RouterAPISecret} {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+	return c
+}
+
+// Returns a copy of the configuration without the routers' secrets or the
+// users' password hashes, for logs.
+func (c Configuration) redacted() Configuration {
+	c.RouterConfig = c.RouterConfig.redacted()
+	routers := make([]RouterConfig, len(c.Routers))
+	for i, r := range c.Routers {
+		routers[i] = r.redacted()
+	}
+	c.Routers = routers
+	users := make([]auth.User, len(c.Users))
+	for i, u := range c.Users {
+		if u.PasswordHash != "" {
+			u.PasswordHash = "REDACTED"
+		}
+		users[i] = u
+	}
+	c.Users = users
+	return c
+}
+
 func loadConfig() (config *Configuration, err error) {
 	file, err := ioutil.ReadFile(*configFile)
 	if err != nil {
@@ -308,39 +905,93 @@ func loadConfig() (config *Configuration, err error) {
 	if err != nil {
 		return
 	}
-	log.Printf("Configuration: %+v", c)
+	log.Printf("Configuration: %+v", c.redacted())
 	config = &c
 	return
 }
 
 func mainLoop() (err error) {
 	flag.Parse()
+	if *hashPassword {
+		return printPasswordHash()
+	}
 	config, err := loadConfig()
 	if err != nil {
 		return
 	}
+	if *dryRun {
+		config.RouterType = "dryrun"
+		config.Routers = nil
+	}
+	authenticator, err := newAuthenticator(config)
+	if err != nil {
+		return
+	}
+	shutdownPolicy, err := watcher.ParseShutdownPolicy(config.ShutdownPolicy)
+	if err != nil {
+		return
+	}
 	watch, err = newWatcher(config)
 	if err != nil {
 		log.Printf("newWatcher() = %v", err)
 		return
 	}
-	defer watch.Close()
 	err = watch.Start()
 	if err != nil {
 		return
 	}
-
-	http.HandleFunc("/addDevice", handleAddDevice)
-	http.HandleFunc("/blockList", handleBlockList)
-	http.HandleFunc("/deviceList", handleDeviceList)
-	http.HandleFunc("/block", handleBlock)
-	http.HandleFunc("/unblock", handleUnblock)
-	http.HandleFunc("/modifyActiveUntil", handleModifyActiveUntil)
-	http.HandleFunc("/uploadDevices", handleUploadDevices)
-	http.HandleFunc("/devices.html", handleDevices)
-	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/", fs)
+	defer func() {
+		shutdownErr := watch.Shutdown(shutdownPolicy)
+		if shutdownErr != nil {
+			log.Printf("watch.Shutdown(%q) = %v", shutdownPolicy, shutdownErr)
+		}
+	}()
+
+	handle := func(pattern string, role auth.Role, handler http.HandlerFunc) {
+		http.Handle(pattern, authenticator.Require(role, handler))
+	}
+	handle("/addDevice", auth.AdminRole, handleAddDevice)
+	handle("/blockList", auth.ReadRole, handleBlockList)
+	handle("/routerStatus", auth.ReadRole, handleRouterStatus)
+	handle("/dryRunHistory", auth.ReadRole, handleDryRunHistory)
+	handle("/deviceList", auth.ReadRole, handleDeviceList)
+	handle("/block", auth.WriteRole, handleBlock)
+	handle("/unblock", auth.WriteRole, handleUnblock)
+	handle("/modifyActiveUntil", auth.WriteRole, handleModifyActiveUntil)
+	handle("/profileList", auth.ReadRole, handleProfileList)
+	handle("/addProfile", auth.AdminRole, handleAddProfile)
+	handle("/modifyProfileActiveUntil", auth.WriteRole, handleModifyProfileActiveUntil)
+	handle("/startQuota", auth.WriteRole, handleStartQuota)
+	handle("/stopQuota", auth.WriteRole, handleStopQuota)
+	handle("/requestTime", auth.ReadRole, handleRequestTime)
+	handle("/timeRequests", auth.ReadRole, handleTimeRequestList)
+	handle("/answerTimeRequest", auth.WriteRole, handleAnswerTimeRequest)
+	handle("/uploadDevices", auth.AdminRole, handleUploadDevices)
+	handle("/devices.html", auth.ReadRole, handleDevices)
+	http.Handle("/", newStaticHandler(authenticator))
 	address := net.JoinHostPort("", strconv.Itoa(config.Port))
-	err = http.ListenAndServe(address, nil)
+	err = serveUntilSignal(&http.Server{Addr: address})
+	return
+}
+
+// Serves until SIGINT or SIGTERM arrives, then waits for the requests in
+// flight to finish.
+func serveUntilSignal(server *http.Server) (err error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err = <-serveErr:
+		return
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
 	return
 }
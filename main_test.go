@@ -0,0 +1,174 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/auth"
+	"github.com/jackpal/SeattleSnowman/clock/clocktest"
+	"github.com/jackpal/SeattleSnowman/db"
+	"github.com/jackpal/SeattleSnowman/router"
+	"github.com/jackpal/SeattleSnowman/watcher"
+)
+
+type nullFirewall struct{}
+
+func (nullFirewall) GetAddressGroup(addressGroup string) (ips router.IPs, err error) {
+	return
+}
+
+func (nullFirewall) SetAddressGroup(addressGroup string, ips router.IPs) (err error) {
+	return
+}
+
+func postForm(t *testing.T, handler http.HandlerFunc, path string, values url.Values) {
+	r := httptest.NewRequest("POST", path, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("POST %s %v = %d %s", path, values, w.Code, w.Body)
+	}
+}
+
+func TestUnblockUsesClock(t *testing.T) {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("time.LoadLocation() = %v", err)
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2015, 3, 3, hour, minute, 0, 0, location) // A Tuesday.
+	}
+	fake := clocktest.NewFakeClock(at(19, 30))
+	calendars, err := db.NewCalendars(&db.CalendarConfig{
+		Location:       "America/Los_Angeles",
+		SchoolDayHours: db.TimeOfDayPeriodsConfig{{StartTime: "4:00PM", EndTime: "8:00PM"}},
+		VacationHours:  db.TimeOfDayPeriodsConfig{{StartTime: "1:00PM", EndTime: "9:00PM"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("db.NewCalendars() = %v", err)
+	}
+	database := db.NewRAMDB()
+	err = database.Open()
+	if err != nil {
+		t.Fatalf("database.Open() = %v", err)
+	}
+	err = database.Add(db.NewDevice("192.168.1.201", "laptop"))
+	if err != nil {
+		t.Fatalf("database.Add() = %v", err)
+	}
+	oldClock, oldWatch := systemClock, watch
+	defer func() { systemClock, watch = oldClock, oldWatch }()
+	systemClock = fake
+	watch = watcher.NewWatcher(database, calendars, nullFirewall{}, "DROP", fake)
+	err = watch.Start()
+	if err != nil {
+		t.Fatalf("watch.Start() = %v", err)
+	}
+	defer watch.Close()
+
+	postForm(t, handleUnblock, "/unblock", url.Values{"ip": {"192.168.1.201"}, "hours": {"1"}})
+	checkBlocked := func(atTime time.Time, expected bool) {
+		fake.Set(atTime)
+		blocked, _, err := watch.BlockList()
+		if err != nil || (len(blocked) == 1) != expected {
+			t.Errorf("at %s watch.BlockList() = %v, %v, expected blocked %v",
+				atTime.Format(time.Kitchen), blocked, err, expected)
+		}
+	}
+	checkBlocked(at(20, 29), false)
+	checkBlocked(at(20, 30), true)
+}
+
+func TestConfigurationRedacted(t *testing.T) {
+	secrets := RouterConfig{RouterPassword: "password", RouterKeyPassphrase: "passphrase",
+		RouterAPIKey: "key", RouterAPISecret: "secret"}
+	config := Configuration{RouterConfig: secrets, Routers: []RouterConfig{secrets},
+		Users: []auth.User{{Name: "parent", PasswordHash: "$2a$10$hash", Role: auth.AdminRole}}}
+	config.RouterAddress = "192.168.1.1"
+	logged := fmt.Sprintf("%+v", config.redacted())
+	for _, secret := range []string{"password", "passphrase", "key", "secret", "$2a$10$hash"} {
+		if strings.Contains(logged, ":"+secret) {
+			t.Errorf("The logged configuration has %q: %s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "192.168.1.1") || !strings.Contains(logged, "parent") {
+		t.Errorf("The logged configuration lost the router address or the user name: %s", logged)
+	}
+	if config.RouterPassword != "password" || config.Routers[0].RouterAPISecret != "secret" ||
+		config.Users[0].PasswordHash != "$2a$10$hash" {
+		t.Errorf("redacted() changed the configuration: %+v", config)
+	}
+}
+
+func TestNewFirewallOneDryRun(t *testing.T) {
+	defer func() { dryRunFirewall = nil }()
+	config := &Configuration{Routers: []RouterConfig{
+		{Name: "main", RouterType: "dryrun"},
+		{Name: "mesh", RouterType: "dryrun"},
+	}}
+	_, err := newFirewall(config)
+	if err == nil || !strings.Contains(err.Error(), `"mesh"`) {
+		t.Errorf("newFirewall() with two dry run routers = %v", err)
+	}
+	config.Routers[1].RouterType = "nftables"
+	_, err = newFirewall(config)
+	if err != nil {
+		t.Errorf("newFirewall() with one dry run router = %v", err)
+	}
+}
+
+func TestMaybeAddDevicesUpdates(t *testing.T) {
+	database := db.NewRAMDB()
+	calendars, err := db.NewCalendars(&db.CalendarConfig{Location: "America/Los_Angeles"}, nil)
+	if err != nil {
+		t.Fatalf("db.NewCalendars() = %v", err)
+	}
+	device := db.NewDevice("192.168.1.201", "laptop")
+	activeUntil := time.Date(2015, 3, 3, 20, 0, 0, 0, time.UTC)
+	device.ActiveUntil = activeUntil
+	err = database.Add(device)
+	if err != nil {
+		t.Fatalf("database.Add() = %v", err)
+	}
+	changed := db.NewDevice("192.168.1.201", "laptop")
+	changed.Profile = "Alice"
+	err = maybeAddDevices(database, calendars, []db.Device{changed, db.NewDevice("192.168.1.202", "phone")})
+	if err != nil {
+		t.Fatalf("maybeAddDevices() = %v", err)
+	}
+	devices, err := database.All()
+	if err != nil || len(devices) != 2 || devices[0].Profile != "Alice" || !devices[0].ActiveUntil.Equal(activeUntil) {
+		t.Errorf("After maybeAddDevices(), the database has %v, %v", devices, err)
+	}
+}
+
+func TestMaybeAddProfilesUpdates(t *testing.T) {
+	database := db.NewRAMDB()
+	calendars, err := db.NewCalendars(&db.CalendarConfig{Location: "America/Los_Angeles"}, nil)
+	if err != nil {
+		t.Fatalf("db.NewCalendars() = %v", err)
+	}
+	profile := db.NewProfile("Carol")
+	profile.DailyQuota = db.Duration(2 * time.Hour)
+	err = database.AddProfile(profile)
+	if err != nil {
+		t.Fatalf("database.AddProfile() = %v", err)
+	}
+	profile.DailyQuota = db.Duration(3 * time.Hour)
+	err = maybeAddProfiles(database, calendars, []db.Profile{profile})
+	if err != nil {
+		t.Fatalf("maybeAddProfiles() = %v", err)
+	}
+	actual, found, err := database.FindProfile("Carol")
+	if err != nil || !found || actual.DailyQuota != profile.DailyQuota {
+		t.Errorf("After maybeAddProfiles(), the database has %v, %v, %v", actual, found, err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/clock"
+)
+
+// How many changes a DryRunFirewall remembers.
+const dryRunHistoryLength = 1000
+
+// A change that a DryRunFirewall made instead of the router.
+type DryRunChange struct {
+	Time   time.Time
+	Group  string
+	Add    IPs
+	Remove IPs
+}
+
+// A firewall that only keeps its address groups in memory, and records how
+// it changes them. Use it to try out a configuration without touching the
+// router.
+type DryRunFirewall struct {
+	clock   clock.Clock
+	mutex   sync.Mutex
+	groups  map[string]IPs
+	history []DryRunChange
+}
+
+func NewDryRunFirewall(clock clock.Clock) *DryRunFirewall {
+	return &DryRunFirewall{clock: clock, groups: make(map[string]IPs)}
+}
+
+func (f *DryRunFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ips = append(ips, f.groups[groupName]...)
+	return
+}
+
+func (f *DryRunFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	addIPs, removeIPs := computeDifference(f.groups[groupName], ips)
+	if len(addIPs) == 0 && len(removeIPs) == 0 {
+		return
+	}
+	log.Printf("Dry run: address group %q add %v remove %v", groupName, addIPs, removeIPs)
+	f.groups[groupName] = append(IPs(nil), ips...)
+	f.history = append(f.history, DryRunChange{f.clock.Now(), groupName, addIPs, removeIPs})
+	if len(f.history) > dryRunHistoryLength {
+		f.history = f.history[len(f.history)-dryRunHistoryLength:]
+	}
+	return
+}
+
+// Returns the changes made so far, oldest first.
+func (f *DryRunFirewall) History() (history []DryRunChange) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append(history, f.history...)
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/clock/clocktest"
+)
+
+func TestDryRunFirewall(t *testing.T) {
+	start := time.Date(2015, 3, 3, 19, 30, 0, 0, time.UTC)
+	c := clocktest.NewFakeClock(start)
+	f := NewDryRunFirewall(c)
+	a, b, d := net.ParseIP("192.168.1.201"), net.ParseIP("192.168.1.202"), net.ParseIP("192.168.1.203")
+
+	ips, err := f.GetAddressGroup(testGroup)
+	if err != nil || len(ips) != 0 {
+		t.Errorf("GetAddressGroup() of a new group = %v, %v", ips, err)
+	}
+	err = f.SetAddressGroup(testGroup, IPs{a, b})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	c.Advance(time.Hour)
+	err = f.SetAddressGroup(testGroup, IPs{b, d})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	// No change, so nothing is recorded.
+	err = f.SetAddressGroup(testGroup, IPs{d, b})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	ips, err = f.GetAddressGroup(testGroup)
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), []string{"192.168.1.202", "192.168.1.203"}) {
+		t.Errorf("GetAddressGroup() = %v, %v", ips, err)
+	}
+	expected := []DryRunChange{
+		DryRunChange{start, testGroup, IPs{a, b}, nil},
+		DryRunChange{start.Add(time.Hour), testGroup, IPs{d}, IPs{a}},
+	}
+	history := f.History()
+	if len(history) != len(expected) {
+		t.Fatalf("History() = %v, expected %v", history, expected)
+	}
+	for i, change := range history {
+		e := expected[i]
+		if !change.Time.Equal(e.Time) || change.Group != e.Group ||
+			!reflect.DeepEqual(ipStrings(change.Add), ipStrings(e.Add)) ||
+			!reflect.DeepEqual(ipStrings(change.Remove), ipStrings(e.Remove)) {
+			t.Errorf("case %d: History() = %v, expected %v", i, change, e)
+		}
+	}
+}
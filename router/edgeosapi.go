@@ -0,0 +1,266 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// An EdgeRouter, controlled through the JSON configuration API of its web
+// interface instead of SSH. It logs in with a user name and password, and
+// logs in again when the session expires.
+type edgeOSAPIFirewall struct {
+	config RESTConfig
+	api    *restAPI
+	// Guards loggedIn.
+	mutex    sync.Mutex
+	loggedIn bool
+}
+
+func NewEdgeOSAPIFirewall(config RESTConfig) (firewall Firewall, err error) {
+	if config.User == "" {
+		config.User = DefaultSSHUser
+	}
+	f := &edgeOSAPIFirewall{config: config}
+	f.api, err = newRESTAPI(config, f.addCSRFToken)
+	if err != nil {
+		return
+	}
+	firewall = f
+	return
+}
+
+// EdgeOS 1.10 and later want the session's CSRF token in a header.
+func (f *edgeOSAPIFirewall) addCSRFToken(r *http.Request) {
+	for _, cookie := range f.api.client.Jar.Cookies(r.URL) {
+		if cookie.Name == "X-CSRF-TOKEN" {
+			r.Header.Set("X-CSRF-TOKEN", cookie.Value)
+		}
+	}
+}
+
+// Logs in with the login form, which answers with a redirect if it worked,
+// and with the form again if it didn't.
+func (f *edgeOSAPIFirewall) login() (err error) {
+	form := url.Values{"username": {f.config.User}, "password": {f.config.Password}}
+	client := *f.api.client
+	client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	response, err := client.PostForm(f.api.baseURL+"/", form)
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSeeOther && response.StatusCode != http.StatusFound {
+		err = fmt.Errorf("EdgeOS login as %q failed: %s", f.config.User, response.Status)
+	}
+	return
+}
+
+// Calls the API, logging in first if need be. If the session has expired,
+// it logs in again and retries once.
+func (f *edgeOSAPIFirewall) call(method string, path string, body interface{}, result interface{}) (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for tries := 0; tries < 2; tries++ {
+		reused := f.loggedIn
+		if !reused {
+			err = f.login()
+			if err != nil {
+				return
+			}
+			f.loggedIn = true
+		}
+		err = f.api.do(method, path, body, result)
+		e, ok := err.(*restError)
+		if !ok || (e.status != http.StatusUnauthorized && e.status != http.StatusForbidden) {
+			return
+		}
+		f.loggedIn = false
+		if !reused {
+			return
+		}
+		log.Printf("EdgeOS session expired, logging in again")
+	}
+	return
+}
+
+/*
+  An example "GET /api/edge/get.json" result (abridged)
+
+  {"success": true,
+   "GET": {"firewall": {"group": {"address-group": {
+     "SEATTLESNOWMAN_DROP": {"address": ["192.168.1.201", "192.168.1.202"],
+                             "description": "Kids devices"}}}}}}
+
+  A group with one address has a string instead of a list.
+*/
+
+type edgeOSConfig struct {
+	Success json.RawMessage
+	Error   json.RawMessage
+	GET     struct {
+		Firewall struct {
+			Group struct {
+				AddressGroup map[string]struct {
+					Address json.RawMessage
+				} `json:"address-group"`
+			}
+		}
+	}
+}
+
+// EdgeOS says "success" with true, "1" or 1, depending on the version and
+// the call.
+func edgeOSSuccess(raw json.RawMessage) bool {
+	switch strings.Trim(string(raw), `"`) {
+	case "true", "1":
+		return true
+	}
+	return false
+}
+
+func (f *edgeOSAPIFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	var config edgeOSConfig
+	err = f.call("GET", "/api/edge/get.json", nil, &config)
+	if err != nil {
+		return
+	}
+	if !edgeOSSuccess(config.Success) {
+		err = fmt.Errorf("EdgeOS get.json failed: %s", config.Error)
+		return
+	}
+	group, ok := config.GET.Firewall.Group.AddressGroup[groupName]
+	if !ok {
+		err = fmt.Errorf("EdgeOS address group %q not found", groupName)
+		return
+	}
+	return parseEdgeOSAddresses(group.Address)
+}
+
+func parseEdgeOSAddresses(raw json.RawMessage) (ips IPs, err error) {
+	var addresses []string
+	if len(raw) > 0 && json.Unmarshal(raw, &addresses) != nil {
+		var address string
+		err = json.Unmarshal(raw, &address)
+		if err != nil {
+			err = fmt.Errorf("Could not parse EdgeOS addresses %s", raw)
+			return
+		}
+		addresses = []string{address}
+	}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			// Ranges are not managed by Seattle Snowman.
+			err = fmt.Errorf("Unsupported address group entry %q", address)
+			return
+		}
+		ips = append(ips, ip)
+	}
+	return
+}
+
+/*
+  An example "POST /api/edge/batch.json" result
+
+  {"success": "1",
+   "SET": {"success": "1", "failure": "0"},
+   "DELETE": {"success": "1", "failure": "0"},
+   "COMMIT": {"success": "1", "failure": "0"}}
+
+  On failure, the step that failed has "success": "0", and "error" is either
+  a message or an object that maps configuration paths to messages.
+*/
+
+type edgeOSStep struct {
+	Success json.RawMessage
+	Error   json.RawMessage
+}
+
+type edgeOSBatchResult struct {
+	Success json.RawMessage
+	Error   json.RawMessage
+	SET     *edgeOSStep
+	DELETE  *edgeOSStep
+	COMMIT  *edgeOSStep
+}
+
+// Returns the configuration tree that sets or deletes the addresses.
+func edgeOSAddressTree(groupName string, ips IPs) map[string]interface{} {
+	var addresses []string
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	return map[string]interface{}{"firewall": map[string]interface{}{
+		"group": map[string]interface{}{"address-group": map[string]interface{}{
+			groupName: map[string]interface{}{"address": addresses}}}}}
+}
+
+func (f *edgeOSAPIFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	currentIPs, err := f.GetAddressGroup(groupName)
+	if err != nil {
+		return
+	}
+	addIPs, deleteIPs := computeDifference(currentIPs, ips)
+	log.Printf("EdgeOS API: updateAddressGroup(%q, %v, %v)", groupName, addIPs, deleteIPs)
+	if len(addIPs) == 0 && len(deleteIPs) == 0 {
+		// Nothing to do.
+		return
+	}
+	// The batch sets, deletes and commits in one configuration session.
+	batch := make(map[string]interface{})
+	if len(addIPs) > 0 {
+		batch["SET"] = edgeOSAddressTree(groupName, addIPs)
+	}
+	if len(deleteIPs) > 0 {
+		batch["DELETE"] = edgeOSAddressTree(groupName, deleteIPs)
+	}
+	var result edgeOSBatchResult
+	err = f.call("POST", "/api/edge/batch.json", batch, &result)
+	if err != nil {
+		return
+	}
+	steps := []struct {
+		name string
+		step *edgeOSStep
+	}{{"SET", result.SET}, {"DELETE", result.DELETE}, {"COMMIT", result.COMMIT}}
+	for _, s := range steps {
+		if s.step != nil && !edgeOSSuccess(s.step.Success) {
+			err = fmt.Errorf("EdgeOS %s failed: %s", s.name, edgeOSErrorMessage(s.step.Error))
+			return
+		}
+	}
+	if !edgeOSSuccess(result.Success) {
+		err = fmt.Errorf("EdgeOS batch failed: %s", edgeOSErrorMessage(result.Error))
+	}
+	return
+}
+
+// Turns an "error" field, which is a message or an object of messages, into
+// one message.
+func edgeOSErrorMessage(raw json.RawMessage) string {
+	var message string
+	if json.Unmarshal(raw, &message) == nil {
+		return message
+	}
+	var messages map[string]string
+	if json.Unmarshal(raw, &messages) == nil {
+		var parts []string
+		for path, m := range messages {
+			parts = append(parts, path+": "+strings.TrimSpace(m))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, "; ")
+	}
+	return string(raw)
+}
@@ -0,0 +1,218 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The web interface of an EdgeRouter with one address group.
+type fakeEdgeOS struct {
+	mutex      sync.Mutex
+	group      string
+	addresses  []string
+	sessions   map[string]bool
+	logins     int
+	failCommit bool
+}
+
+func (f *fakeEdgeOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.Method == "POST" && r.URL.Path == "/" {
+		if r.FormValue("username") != "ubnt" || r.FormValue("password") != "secret" {
+			// The login form, again.
+			fmt.Fprintf(w, "<html>Invalid username or password</html>")
+			return
+		}
+		f.logins++
+		session := fmt.Sprintf("session%d", f.logins)
+		f.sessions[session] = true
+		http.SetCookie(w, &http.Cookie{Name: "beaker.session.id", Value: session, Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "X-CSRF-TOKEN", Value: "csrf-" + session, Path: "/"})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	cookie, err := r.Cookie("beaker.session.id")
+	if err != nil || !f.sessions[cookie.Value] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-CSRF-TOKEN") != "csrf-"+cookie.Value {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/edge/get.json":
+		var address interface{} = f.addresses
+		if len(f.addresses) == 1 {
+			address = f.addresses[0]
+		}
+		group := map[string]interface{}{"description": "Kids devices"}
+		if len(f.addresses) > 0 {
+			group["address"] = address
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true,
+			"GET": map[string]interface{}{"firewall": map[string]interface{}{
+				"group": map[string]interface{}{"address-group": map[string]interface{}{
+					f.group: group}}}}})
+	case r.Method == "POST" && r.URL.Path == "/api/edge/batch.json":
+		var batch map[string]map[string]map[string]map[string]map[string]struct{ Address []string }
+		err := json.NewDecoder(r.Body).Decode(&batch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result := map[string]interface{}{"success": "1"}
+		addresses := append([]string{}, f.addresses...)
+		for _, verb := range []string{"SET", "DELETE"} {
+			tree, ok := batch[verb]
+			if !ok {
+				continue
+			}
+			result[verb] = map[string]string{"success": "1", "failure": "0"}
+			for _, a := range tree["firewall"]["group"]["address-group"][f.group].Address {
+				if net.ParseIP(a) == nil {
+					result[verb] = map[string]interface{}{"success": "0", "failure": "1",
+						"error": map[string]string{"firewall group address-group " + f.group + " address " + a: "Invalid address\n"}}
+					result["success"] = "0"
+					json.NewEncoder(w).Encode(result)
+					return
+				}
+				if verb == "SET" {
+					addresses = append(addresses, a)
+				} else {
+					addresses = removeString(addresses, a)
+				}
+			}
+		}
+		if f.failCommit {
+			result["COMMIT"] = map[string]interface{}{"success": "0", "failure": "1",
+				"error": "Commit failed"}
+			result["success"] = "0"
+		} else {
+			result["COMMIT"] = map[string]string{"success": "1", "failure": "0"}
+			f.addresses = addresses
+		}
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func removeString(addresses []string, address string) (result []string) {
+	for _, a := range addresses {
+		if a != address {
+			result = append(result, a)
+		}
+	}
+	return
+}
+
+func (f *fakeEdgeOS) state() (addresses []string, logins int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append(addresses, f.addresses...), f.logins
+}
+
+func TestEdgeOSAPIFirewall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edgeosapi")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fake := &fakeEdgeOS{group: testGroup, addresses: []string{"192.168.1.201"},
+		sessions: make(map[string]bool)}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	config := RESTConfig{Address: server.URL, Password: "secret",
+		CACertPath: serverCertHelper(t, server, dir)}
+	f, err := NewEdgeOSAPIFirewall(config)
+	if err != nil {
+		t.Fatalf("NewEdgeOSAPIFirewall() = %v", err)
+	}
+
+	// A group with one address.
+	ips, err := f.GetAddressGroup(testGroup)
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), []string{"192.168.1.201"}) {
+		t.Errorf("GetAddressGroup() = %v, %v", ips, err)
+	}
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.202"), net.ParseIP("192.168.1.203")})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	expected := []string{"192.168.1.202", "192.168.1.203"}
+	if addresses, logins := fake.state(); !reflect.DeepEqual(addresses, expected) || logins != 1 {
+		t.Errorf("After SetAddressGroup(), the router has %v after %d logins, expected %v after 1",
+			addresses, logins, expected)
+	}
+
+	// The session expires.
+	fake.mutex.Lock()
+	fake.sessions = make(map[string]bool)
+	fake.mutex.Unlock()
+	ips, err = f.GetAddressGroup(testGroup)
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), expected) {
+		t.Errorf("GetAddressGroup() after the session expired = %v, %v", ips, err)
+	}
+	if _, logins := fake.state(); logins != 2 {
+		t.Errorf("Logged in %d times, expected 2", logins)
+	}
+
+	fake.mutex.Lock()
+	fake.failCommit = true
+	fake.mutex.Unlock()
+	err = f.SetAddressGroup(testGroup, nil)
+	if err == nil || !strings.Contains(err.Error(), "Commit failed") {
+		t.Errorf("SetAddressGroup() when the commit fails = %v", err)
+	}
+	if addresses, _ := fake.state(); !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("A failed commit changed the router to %v", addresses)
+	}
+
+	_, err = f.GetAddressGroup("OTHER")
+	if err == nil {
+		t.Errorf("GetAddressGroup() of a missing group succeeded")
+	}
+
+	config.Password = "wrong"
+	f, err = NewEdgeOSAPIFirewall(config)
+	if err != nil {
+		t.Fatalf("NewEdgeOSAPIFirewall() = %v", err)
+	}
+	_, err = f.GetAddressGroup(testGroup)
+	if err == nil || !strings.Contains(err.Error(), "login") {
+		t.Errorf("GetAddressGroup() with the wrong password = %v", err)
+	}
+}
+
+// edgeOSErrorMessage test case
+type eemtc struct {
+	raw      string
+	expected string
+}
+
+var edgeOSErrorMessageTestCases = []eemtc{
+	eemtc{`"Commit failed"`, "Commit failed"},
+	eemtc{`{"b path": "B\n", "a path": "A"}`, "a path: A; b path: B"},
+	eemtc{`42`, "42"},
+}
+
+func TestEdgeOSErrorMessage(t *testing.T) {
+	for i, tc := range edgeOSErrorMessageTestCases {
+		actual := edgeOSErrorMessage(json.RawMessage(tc.raw))
+		if actual != tc.expected {
+			t.Errorf("case %d: edgeOSErrorMessage(%s) = %q, expected %q", i, tc.raw, actual, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Returns ~/.ssh/known_hosts.
+func DefaultKnownHostsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".ssh", "known_hosts")
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// Checks SSH host keys against a known_hosts file, so that our commands only
+// go to the real router.
+type hostKeyChecker struct {
+	mutex sync.Mutex
+	path  string
+	// Trust on first use: add the key of a host that is not in the file.
+	pin bool
+}
+
+func newHostKeyChecker(path string, pin bool) *hostKeyChecker {
+	if path == "" {
+		path = DefaultKnownHostsPath()
+	}
+	return &hostKeyChecker{path: path, pin: pin}
+}
+
+// An ssh.HostKeyCallback.
+func (h *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) (err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.pin {
+		// knownhosts.New needs the file to exist.
+		err = h.ensureFile()
+		if err != nil {
+			return
+		}
+	}
+	callback, err := knownhosts.New(h.path)
+	if err != nil {
+		return fmt.Errorf("Could not read known hosts file: %v", err)
+	}
+	err = callback(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if err == nil || !errors.As(err, &keyErr) {
+		return
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	if len(keyErr.Want) > 0 {
+		want := keyErr.Want[0]
+		return fmt.Errorf("The host key of %s has changed! It is now %s %s, but %s:%d has %s. "+
+			"If the router was reset or replaced, remove the old key from %s",
+			hostname, key.Type(), fingerprint, want.Filename, want.Line,
+			ssh.FingerprintSHA256(want.Key), want.Filename)
+	}
+	if !h.pin {
+		return fmt.Errorf("The host key of %s (%s %s) is not in %s. "+
+			"Add it, or set RouterPinHostKey to trust it the first time",
+			hostname, key.Type(), fingerprint, h.path)
+	}
+	err = h.addKey(hostname, remote, key)
+	if err != nil {
+		return
+	}
+	log.Printf("Pinned the host key of %s (%s %s) in %s", hostname, key.Type(), fingerprint, h.path)
+	return
+}
+
+func (h *hostKeyChecker) ensureFile() (err error) {
+	err = os.MkdirAll(filepath.Dir(h.path), 0700)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return
+	}
+	return file.Close()
+}
+
+func (h *hostKeyChecker) addKey(hostname string, remote net.Addr, key ssh.PublicKey) (err error) {
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && remote.String() != hostname {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+	file, err := os.OpenFile(h.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintln(file, knownhosts.Line(addresses, key))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKeyHelper(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() = %v", err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey() = %v", err)
+	}
+	return key
+}
+
+func TestHostKeyChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostkey")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ssh", "known_hosts")
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 22}
+	routerKey := newHostKeyHelper(t)
+	impostorKey := newHostKeyHelper(t)
+
+	strict := newHostKeyChecker(path, false)
+	err = strict.check("192.168.1.1:22", remote, routerKey)
+	if err == nil {
+		t.Errorf("check() of an unknown host without pinning succeeded")
+	}
+
+	pinning := newHostKeyChecker(path, true)
+	err = pinning.check("192.168.1.1:22", remote, routerKey)
+	if err != nil {
+		t.Errorf("check() with pinning = %v", err)
+	}
+	// Now the key is known, even without pinning.
+	err = strict.check("192.168.1.1:22", remote, routerKey)
+	if err != nil {
+		t.Errorf("check() of the pinned key = %v", err)
+	}
+
+	for _, checker := range []*hostKeyChecker{strict, pinning} {
+		err = checker.check("192.168.1.1:22", remote, impostorKey)
+		if err == nil || !strings.Contains(err.Error(), "has changed") {
+			t.Errorf("check() of a changed key = %v", err)
+		}
+	}
+}
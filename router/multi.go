@@ -0,0 +1,201 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/clock"
+)
+
+// Which of a MultiFirewall's firewalls must succeed for a call to succeed.
+type PartialFailurePolicy string
+
+const (
+	// Every firewall. When one fails, the call fails, and the watcher tries
+	// them all again later.
+	RequireAll PartialFailurePolicy = "all"
+	// The first firewall, usually the main router. Failures of the others are
+	// only logged and reported in their status.
+	RequireFirst PartialFailurePolicy = "first"
+	// At least one firewall.
+	RequireAny PartialFailurePolicy = "any"
+)
+
+const DefaultPartialFailurePolicy = RequireAll
+
+// Parses a partial failure policy. The empty string means
+// DefaultPartialFailurePolicy.
+func ParsePartialFailurePolicy(s string) (policy PartialFailurePolicy, err error) {
+	switch policy = PartialFailurePolicy(s); policy {
+	case "":
+		policy = DefaultPartialFailurePolicy
+	case RequireAll, RequireFirst, RequireAny:
+	default:
+		err = fmt.Errorf("Unknown partial failure policy %q", s)
+	}
+	return
+}
+
+// Returned, wrapped, by MultiFirewall.GetAddressGroup when its firewalls have
+// different addresses in the group. Setting the group makes them agree again.
+var ErrFirewallsDisagree = errors.New("The firewalls have different address groups")
+
+// One of a MultiFirewall's firewalls.
+type NamedFirewall struct {
+	Name     string // Used in logs and status.
+	Firewall Firewall
+}
+
+// How the calls to one of a MultiFirewall's firewalls have gone.
+type FirewallStatus struct {
+	Name                string
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	LastError           string
+	ConsecutiveFailures int
+}
+
+// A firewall that is several firewalls, like a main router and a mesh access
+// point that both have to block the devices. Calls go to all of them at
+// once, and the policy decides which failures fail the call.
+type MultiFirewall struct {
+	firewalls []NamedFirewall
+	policy    PartialFailurePolicy
+	clock     clock.Clock
+	mutex     sync.Mutex // Guards status.
+	status    []FirewallStatus
+}
+
+func NewMultiFirewall(firewalls []NamedFirewall, policy PartialFailurePolicy, clock clock.Clock) *MultiFirewall {
+	m := &MultiFirewall{firewalls: firewalls, policy: policy, clock: clock}
+	for _, f := range firewalls {
+		m.status = append(m.status, FirewallStatus{Name: f.Name})
+	}
+	return m
+}
+
+// Returns the status of each firewall, in order.
+func (m *MultiFirewall) Status() []FirewallStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]FirewallStatus(nil), m.status...)
+}
+
+// Calls call with every firewall and its index at once, and records how each
+// call went. errs[i] is the error of firewall i.
+func (m *MultiFirewall) each(call func(i int, f Firewall) error) (errs []error) {
+	errs = make([]error, len(m.firewalls))
+	var wg sync.WaitGroup
+	for i, f := range m.firewalls {
+		wg.Add(1)
+		go func(i int, f Firewall) {
+			defer wg.Done()
+			errs[i] = call(i, f)
+		}(i, f.Firewall)
+	}
+	wg.Wait()
+	now := m.clock.Now()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, err := range errs {
+		s := &m.status[i]
+		if err == nil {
+			if s.ConsecutiveFailures > 0 {
+				log.Printf("Router %q is back", s.Name)
+			}
+			s.LastSuccess = now
+			s.ConsecutiveFailures = 0
+			continue
+		}
+		if s.ConsecutiveFailures == 0 {
+			log.Printf("Router %q failed: %v", s.Name, err)
+		}
+		s.LastFailure = now
+		s.LastError = err.Error()
+		s.ConsecutiveFailures++
+	}
+	return
+}
+
+// Returns an error if errs has more failures than the policy allows.
+func (m *MultiFirewall) check(errs []error) (err error) {
+	var failures []string
+	for i, e := range errs {
+		if e != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", m.firewalls[i].Name, e))
+		}
+	}
+	var ok bool
+	switch m.policy {
+	case RequireFirst:
+		ok = len(errs) > 0 && errs[0] == nil
+	case RequireAny:
+		ok = len(failures) < len(errs)
+	default:
+		ok = len(failures) == 0
+	}
+	if !ok {
+		err = fmt.Errorf("%d of %d routers failed: %s", len(failures), len(errs),
+			strings.Join(failures, "; "))
+	}
+	return
+}
+
+// Returns the group of the firewalls that answered, if they agree. When the
+// policy lets some fail, a firewall that missed an update is caught up the
+// next time the watcher reconciles, since it then disagrees with the others.
+func (m *MultiFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	groups := make([]IPs, len(m.firewalls))
+	errs := m.each(func(i int, f Firewall) (err error) {
+		groups[i], err = f.GetAddressGroup(groupName)
+		return
+	})
+	err = m.check(errs)
+	if err != nil {
+		return
+	}
+	first := -1
+	for i, group := range groups {
+		if errs[i] != nil {
+			continue
+		}
+		if first < 0 {
+			first = i
+			ips = group
+			continue
+		}
+		if len(group.RemoveAll(ips)) > 0 || len(ips.RemoveAll(group)) > 0 {
+			err = fmt.Errorf("%w: %s has %v, %s has %v", ErrFirewallsDisagree,
+				m.firewalls[first].Name, ips, m.firewalls[i].Name, group)
+			ips = nil
+			return
+		}
+	}
+	return
+}
+
+func (m *MultiFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	errs := m.each(func(i int, f Firewall) error {
+		return f.SetAddressGroup(groupName, ips)
+	})
+	return m.check(errs)
+}
+
+// Closes the firewalls that are io.Closers, and returns the first error.
+func (m *MultiFirewall) Close() (err error) {
+	for _, f := range m.firewalls {
+		if closer, ok := f.Firewall.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/clock/clocktest"
+)
+
+// A router in memory that can be made unreachable.
+type flakyFirewall struct {
+	*DryRunFirewall
+	mutex  sync.Mutex
+	fail   bool
+	closed bool
+}
+
+func (f *flakyFirewall) err() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.fail {
+		return fmt.Errorf("dial tcp: connection refused")
+	}
+	return nil
+}
+
+func (f *flakyFirewall) setFail(fail bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.fail = fail
+}
+
+func (f *flakyFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	err = f.err()
+	if err != nil {
+		return
+	}
+	return f.DryRunFirewall.GetAddressGroup(groupName)
+}
+
+func (f *flakyFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	err = f.err()
+	if err != nil {
+		return
+	}
+	return f.DryRunFirewall.SetAddressGroup(groupName, ips)
+}
+
+func (f *flakyFirewall) Close() (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return
+}
+
+func newMultiFirewallHelper(policy PartialFailurePolicy) (m *MultiFirewall, c *clocktest.FakeClock, main *flakyFirewall, mesh *flakyFirewall) {
+	c = clocktest.NewFakeClock(time.Date(2015, 3, 3, 19, 30, 0, 0, time.UTC))
+	main = &flakyFirewall{DryRunFirewall: NewDryRunFirewall(c)}
+	mesh = &flakyFirewall{DryRunFirewall: NewDryRunFirewall(c)}
+	m = NewMultiFirewall([]NamedFirewall{{"main", main}, {"mesh", mesh}}, policy, c)
+	return
+}
+
+func TestMultiFirewall(t *testing.T) {
+	m, c, main, mesh := newMultiFirewallHelper(RequireAll)
+	a, b := net.ParseIP("192.168.1.201"), net.ParseIP("192.168.1.202")
+
+	err := m.SetAddressGroup(testGroup, IPs{a, b})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	for _, f := range []*flakyFirewall{main, mesh} {
+		if ips, _ := f.DryRunFirewall.GetAddressGroup(testGroup); len(ips) != 2 {
+			t.Errorf("After SetAddressGroup(), a router has %v", ips)
+		}
+	}
+	ips, err := m.GetAddressGroup(testGroup)
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), []string{"192.168.1.201", "192.168.1.202"}) {
+		t.Errorf("GetAddressGroup() = %v, %v", ips, err)
+	}
+
+	// The routers disagree.
+	mesh.DryRunFirewall.SetAddressGroup(testGroup, IPs{a})
+	_, err = m.GetAddressGroup(testGroup)
+	if !errors.Is(err, ErrFirewallsDisagree) {
+		t.Errorf("GetAddressGroup() of routers that disagree = %v", err)
+	}
+
+	c.Advance(time.Minute)
+	mesh.setFail(true)
+	err = m.SetAddressGroup(testGroup, IPs{a})
+	if err == nil || !strings.Contains(err.Error(), "mesh: dial tcp") {
+		t.Errorf("SetAddressGroup() with the mesh down = %v", err)
+	}
+	if ips, _ := main.DryRunFirewall.GetAddressGroup(testGroup); len(ips) != 1 {
+		t.Errorf("The main router was not updated while the mesh was down, it has %v", ips)
+	}
+	status := m.Status()
+	if len(status) != 2 || status[0].Name != "main" || status[0].ConsecutiveFailures != 0 ||
+		!status[0].LastSuccess.Equal(c.Now()) {
+		t.Errorf("Status() of the main router = %+v", status)
+	}
+	if len(status) != 2 || status[1].ConsecutiveFailures != 1 || !status[1].LastFailure.Equal(c.Now()) ||
+		status[1].LastError != "dial tcp: connection refused" {
+		t.Errorf("Status() of the mesh = %+v", status)
+	}
+
+	err = m.Close()
+	if err != nil || !main.closed || !mesh.closed {
+		t.Errorf("Close() = %v, closed %v and %v", err, main.closed, mesh.closed)
+	}
+}
+
+// Partial failure test case
+type pftc struct {
+	policy   PartialFailurePolicy
+	mainFail bool
+	meshFail bool
+	fails    bool
+}
+
+var partialFailureTestCases = []pftc{
+	pftc{RequireAll, false, false, false},
+	pftc{RequireAll, false, true, true},
+	pftc{RequireAll, true, false, true},
+	pftc{RequireFirst, false, true, false},
+	pftc{RequireFirst, true, false, true},
+	pftc{RequireAny, false, true, false},
+	pftc{RequireAny, true, false, false},
+	pftc{RequireAny, true, true, true},
+}
+
+func TestMultiFirewallPartialFailure(t *testing.T) {
+	for i, tc := range partialFailureTestCases {
+		m, _, main, mesh := newMultiFirewallHelper(tc.policy)
+		main.setFail(tc.mainFail)
+		mesh.setFail(tc.meshFail)
+		err := m.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.201")})
+		if (err != nil) != tc.fails {
+			t.Errorf("case %d: SetAddressGroup() with policy %q = %v", i, tc.policy, err)
+		}
+		ips, err := m.GetAddressGroup(testGroup)
+		if (err != nil) != tc.fails || (err == nil && len(ips) != 1) {
+			t.Errorf("case %d: GetAddressGroup() with policy %q = %v, %v", i, tc.policy, ips, err)
+		}
+	}
+}
+
+// ParsePartialFailurePolicy test case
+type ppfptc struct {
+	s        string
+	expected PartialFailurePolicy
+	ok       bool
+}
+
+var parsePartialFailurePolicyTestCases = []ppfptc{
+	ppfptc{"", RequireAll, true},
+	ppfptc{"all", RequireAll, true},
+	ppfptc{"first", RequireFirst, true},
+	ppfptc{"any", RequireAny, true},
+	ppfptc{"most", "", false},
+}
+
+func TestParsePartialFailurePolicy(t *testing.T) {
+	for i, tc := range parsePartialFailurePolicyTestCases {
+		policy, err := ParsePartialFailurePolicy(tc.s)
+		if (err == nil) != tc.ok || (tc.ok && policy != tc.expected) {
+			t.Errorf("case %d: ParsePartialFailurePolicy(%q) = %q, %v", i, tc.s, policy, err)
+		}
+	}
+}
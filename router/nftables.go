@@ -0,0 +1,151 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Runs commands on behalf of a firewall. Tests substitute a fake.
+type CommandRunner interface {
+	// Run the named command and return its standard output.
+	Run(name string, args ...string) (stdout string, err error)
+}
+
+type execRunner struct{}
+
+// A CommandRunner that runs commands on the local machine.
+func NewExecRunner() CommandRunner {
+	return execRunner{}
+}
+
+func (execRunner) Run(name string, args ...string) (stdout string, err error) {
+	var stdoutBuffer bytes.Buffer
+	var stderrBuffer bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdoutBuffer
+	cmd.Stderr = &stderrBuffer
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err,
+			strings.TrimSpace(stderrBuffer.String()))
+		return
+	}
+	stdout = stdoutBuffer.String()
+	return
+}
+
+// A firewall running on the local machine, using an nftables set as the
+// address group. The set must already exist, for example:
+//
+//	nft add set inet filter SEATTLESNOWMAN_DROP '{ type ipv4_addr; }'
+type nftablesFirewall struct {
+	family string
+	table  string
+	runner CommandRunner
+}
+
+func NewNFTablesFirewall(family string, table string, runner CommandRunner) Firewall {
+	return &nftablesFirewall{family, table, runner}
+}
+
+func (f *nftablesFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	result, err := f.runner.Run("nft", "-j", "list", "set", f.family, f.table, groupName)
+	if err != nil {
+		return
+	}
+	ips, err = parseNFTablesSet(result, groupName)
+	return
+}
+
+func (f *nftablesFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	currentIPs, err := f.GetAddressGroup(groupName)
+	if err != nil {
+		return
+	}
+	addIPs, deleteIPs := computeDifference(currentIPs, ips)
+	log.Printf("nftables: updateAddressGroup(%q, %v, %v)", groupName, addIPs, deleteIPs)
+	if len(addIPs) == 0 && len(deleteIPs) == 0 {
+		// Nothing to do.
+		return
+	}
+	// nft runs all the commands on its command line as a single transaction.
+	var args []string
+	if len(addIPs) > 0 {
+		args = append(args, f.elementCommand("add", groupName, addIPs)...)
+	}
+	if len(deleteIPs) > 0 {
+		if len(args) > 0 {
+			args = append(args, ";")
+		}
+		args = append(args, f.elementCommand("delete", groupName, deleteIPs)...)
+	}
+	_, err = f.runner.Run("nft", args...)
+	return
+}
+
+func (f *nftablesFirewall) elementCommand(verb string, groupName string, ips IPs) []string {
+	var elements []string
+	for _, ip := range ips {
+		elements = append(elements, ip.String())
+	}
+	return []string{verb, "element", f.family, f.table, groupName,
+		"{ " + strings.Join(elements, ", ") + " }"}
+}
+
+/*
+  An example "nft -j list set" result (reformatted)
+
+  {"nftables": [
+    {"metainfo": {"version": "1.0.6", "release_name": "Lester Gooch #5", "json_schema_version": 1}},
+    {"set": {"family": "inet", "name": "SEATTLESNOWMAN_DROP", "table": "filter",
+      "type": "ipv4_addr", "handle": 3, "elem": ["192.168.1.201", "192.168.1.202"]}}
+  ]}
+*/
+
+type nftablesOutput struct {
+	Nftables []struct {
+		Set *struct {
+			Name string
+			Elem []json.RawMessage
+		}
+	}
+}
+
+func parseNFTablesSet(src string, setName string) (ips IPs, err error) {
+	var output nftablesOutput
+	err = json.Unmarshal([]byte(src), &output)
+	if err != nil {
+		return
+	}
+	for _, object := range output.Nftables {
+		if object.Set == nil || object.Set.Name != setName {
+			continue
+		}
+		for _, elem := range object.Set.Elem {
+			var value string
+			// Only plain addresses are supported. Ranges, prefixes and
+			// elements with timeouts are not managed by Seattle Snowman.
+			err = json.Unmarshal(elem, &value)
+			if err != nil {
+				err = fmt.Errorf("Unsupported set element %s", elem)
+				return
+			}
+			ip := net.ParseIP(value)
+			if ip == nil {
+				err = fmt.Errorf("Could not parse set element %q", value)
+				return
+			}
+			ips = append(ips, ip)
+		}
+		return
+	}
+	err = fmt.Errorf("Set %q not found", setName)
+	return
+}
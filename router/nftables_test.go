@@ -0,0 +1,168 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A fake CommandRunner that emulates nft managing a single set.
+type fakeNFT struct {
+	setName  string
+	elements IPs
+	commands []string
+	fail     bool
+}
+
+func (f *fakeNFT) Run(name string, args ...string) (stdout string, err error) {
+	command := name + " " + strings.Join(args, " ")
+	f.commands = append(f.commands, command)
+	if f.fail {
+		err = fmt.Errorf("%s: Operation not permitted", command)
+		return
+	}
+	if name != "nft" {
+		err = fmt.Errorf("unexpected command %q", command)
+		return
+	}
+	if command == "nft -j list set inet filter "+f.setName {
+		var elem []string
+		for _, ip := range f.elements {
+			elem = append(elem, ip.String())
+		}
+		set := map[string]interface{}{"family": "inet", "table": "filter",
+			"name": f.setName, "type": "ipv4_addr", "elem": elem}
+		output := map[string]interface{}{"nftables": []interface{}{
+			map[string]interface{}{"metainfo": map[string]interface{}{"version": "1.0.6"}},
+			map[string]interface{}{"set": set},
+		}}
+		var js []byte
+		js, err = json.Marshal(output)
+		stdout = string(js)
+		return
+	}
+	for _, c := range strings.Split(command[len("nft "):], " ; ") {
+		err = f.runElementCommand(c)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (f *fakeNFT) runElementCommand(c string) (err error) {
+	var verb string
+	var ips IPs
+	prefix := " element inet filter " + f.setName + " { "
+	start := strings.Index(c, prefix)
+	if start < 0 || !strings.HasSuffix(c, " }") {
+		return fmt.Errorf("unexpected command %q", c)
+	}
+	verb = c[:start]
+	for _, s := range strings.Split(c[start+len(prefix):len(c)-2], ", ") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("bad element %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	switch verb {
+	case "add":
+		f.elements = f.elements.AddAll(ips)
+	case "delete":
+		f.elements = f.elements.RemoveAll(ips)
+	default:
+		err = fmt.Errorf("unexpected verb %q", verb)
+	}
+	return
+}
+
+func parseIPsHelper(ips ...string) (result IPs) {
+	for _, ip := range ips {
+		result = append(result, net.ParseIP(ip))
+	}
+	return
+}
+
+func sameIPs(a IPs, b IPs) bool {
+	return len(a.RemoveAll(b)) == 0 && len(b.RemoveAll(a)) == 0
+}
+
+func TestNFTablesFirewall(t *testing.T) {
+	fake := &fakeNFT{setName: "DROP", elements: parseIPsHelper("10.0.0.1", "10.0.0.2")}
+	firewall := NewNFTablesFirewall("inet", "filter", fake)
+
+	ips, err := firewall.GetAddressGroup("DROP")
+	if err != nil || !sameIPs(ips, fake.elements) {
+		t.Errorf("GetAddressGroup() = %v, %v, expected %v", ips, err, fake.elements)
+	}
+
+	want := parseIPsHelper("10.0.0.2", "10.0.0.3")
+	err = firewall.SetAddressGroup("DROP", want)
+	if err != nil {
+		t.Errorf("SetAddressGroup(%v) = %v", want, err)
+	}
+	if !sameIPs(fake.elements, want) {
+		t.Errorf("after SetAddressGroup(%v) set = %v", want, fake.elements)
+	}
+	expectedUpdate := "nft add element inet filter DROP { 10.0.0.3 } ; delete element inet filter DROP { 10.0.0.1 }"
+	if last := fake.commands[len(fake.commands)-1]; last != expectedUpdate {
+		t.Errorf("update command = %q, expected %q", last, expectedUpdate)
+	}
+
+	// No changes means no update command.
+	fake.commands = nil
+	err = firewall.SetAddressGroup("DROP", want)
+	if err != nil || len(fake.commands) != 1 {
+		t.Errorf("SetAddressGroup(unchanged) = %v, commands %q", err, fake.commands)
+	}
+
+	fake.fail = true
+	err = firewall.SetAddressGroup("DROP", nil)
+	if err == nil {
+		t.Errorf("SetAddressGroup() with failing nft succeeded")
+	}
+}
+
+func TestNFTablesMissingSet(t *testing.T) {
+	fake := &fakeNFT{setName: "DROP"}
+	firewall := NewNFTablesFirewall("inet", "filter", fake)
+	_, err := firewall.GetAddressGroup("OTHER")
+	if err == nil {
+		t.Errorf("GetAddressGroup(\"OTHER\") succeeded")
+	}
+}
+
+// parseNFTablesSet test case
+type pnstc struct {
+	src      string
+	expected IPs
+	isError  bool
+}
+
+var parseNFTablesSetTestCases = []pnstc{
+	pnstc{`{"nftables": [{"set": {"name": "DROP", "elem": ["192.168.1.201", "192.168.1.202"]}}]}`,
+		parseIPsHelper("192.168.1.201", "192.168.1.202"), false},
+	pnstc{`{"nftables": [{"metainfo": {}}, {"set": {"name": "DROP"}}]}`, nil, false},
+	pnstc{`{"nftables": [{"set": {"name": "OTHER"}}]}`, nil, true},
+	pnstc{`{"nftables": [{"set": {"name": "DROP", "elem": [{"prefix": {"addr": "10.0.0.0", "len": 8}}]}}]}`, nil, true},
+	pnstc{`{"nftables": [{"set": {"name": "DROP", "elem": ["bogus"]}}]}`, nil, true},
+	pnstc{`Error: No such file or directory`, nil, true},
+}
+
+func TestParseNFTablesSet(t *testing.T) {
+	for i, tc := range parseNFTablesSetTestCases {
+		ips, err := parseNFTablesSet(tc.src, "DROP")
+		if (err != nil) != tc.isError {
+			t.Errorf("case %d: parseNFTablesSet(%q) error = %v", i, tc.src, err)
+			continue
+		}
+		if !sameIPs(ips, tc.expected) {
+			t.Errorf("case %d: parseNFTablesSet(%q) = %v, expected %v", i, tc.src, ips, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// The user that OpenWrt routers log in as, unless SSHConfig.User says
+// otherwise.
+const DefaultOpenWrtUser = "root"
+
+// An OpenWrt router, controlled over SSH. The Firewall does the work, running
+// its commands over the connection.
+type openWrtFirewall struct {
+	*sshConnection
+	Firewall
+}
+
+func newOpenWrtConnection(config SSHConfig) *sshConnection {
+	if config.User == "" {
+		config.User = DefaultOpenWrtUser
+	}
+	return newSSHConnection(config)
+}
+
+// Returns a Firewall that manages an nftables set on an OpenWrt router with
+// the nft command. fw4 keeps its sets in the "inet" "fw4" table. The set is
+// emptied whenever the router reloads its firewall, until the next update.
+func NewOpenWrtNFTablesFirewall(config SSHConfig, family string, table string) Firewall {
+	conn := newOpenWrtConnection(config)
+	return &openWrtFirewall{conn, NewNFTablesFirewall(family, table, conn)}
+}
+
+// Returns a Firewall that manages the entries of a firewall ipset in the
+// router's uci configuration, so that they survive reboots.
+func NewOpenWrtUCIFirewall(config SSHConfig) Firewall {
+	conn := newOpenWrtConnection(config)
+	return &openWrtFirewall{conn, NewUCIFirewall(conn)}
+}
+
+// A firewall that keeps its address groups in the entries of uci firewall
+// ipsets. The ipset must already exist, for example:
+//
+//	uci set firewall.seattlesnowman=ipset
+//	uci set firewall.seattlesnowman.name=SEATTLESNOWMAN_DROP
+//	uci set firewall.seattlesnowman.match=src_ip
+//	uci commit firewall
+type uciFirewall struct {
+	runner CommandRunner
+}
+
+func NewUCIFirewall(runner CommandRunner) Firewall {
+	return &uciFirewall{runner}
+}
+
+func (f *uciFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	_, ips, err = f.getIPSet(groupName)
+	return
+}
+
+// Returns the name of the ipset's section, and its entries.
+func (f *uciFirewall) getIPSet(groupName string) (section string, ips IPs, err error) {
+	result, err := f.runner.Run("uci", "-X", "show", "firewall")
+	if err != nil {
+		return
+	}
+	return parseUCIIPSet(result, groupName)
+}
+
+func (f *uciFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	section, currentIPs, err := f.getIPSet(groupName)
+	if err != nil {
+		return
+	}
+	addIPs, deleteIPs := computeDifference(currentIPs, ips)
+	log.Printf("uci: updateAddressGroup(%q, %v, %v)", groupName, addIPs, deleteIPs)
+	if len(addIPs) == 0 && len(deleteIPs) == 0 {
+		// Nothing to do.
+		return
+	}
+	option := "firewall." + section + ".entry"
+	for _, ip := range addIPs {
+		_, err = f.runner.Run("uci", "add_list", option+"="+ip.String())
+		if err != nil {
+			f.revert()
+			return
+		}
+	}
+	for _, ip := range deleteIPs {
+		_, err = f.runner.Run("uci", "del_list", option+"="+ip.String())
+		if err != nil {
+			f.revert()
+			return
+		}
+	}
+	_, err = f.runner.Run("uci", "commit", "firewall")
+	if err != nil {
+		f.revert()
+		return
+	}
+	_, err = f.runner.Run("/etc/init.d/firewall", "reload")
+	return
+}
+
+// Throws away uncommitted changes, so that the next commit doesn't include
+// them.
+func (f *uciFirewall) revert() {
+	_, err := f.runner.Run("uci", "revert", "firewall")
+	if err != nil {
+		log.Printf("uci revert firewall: %v", err)
+	}
+}
+
+/*
+  An example "uci -X show firewall" result (abridged)
+
+firewall.cfg01e63d=defaults
+firewall.cfg01e63d.syn_flood='1'
+firewall.seattlesnowman=ipset
+firewall.seattlesnowman.name='SEATTLESNOWMAN_DROP'
+firewall.seattlesnowman.match='src_ip'
+firewall.seattlesnowman.entry='192.168.1.201' '192.168.1.202'
+firewall.cfg0c92bd=rule
+firewall.cfg0c92bd.name='Seattle Snowman'
+firewall.cfg0c92bd.ipset='SEATTLESNOWMAN_DROP'
+*/
+
+type uciSection struct {
+	name    string
+	typ     string
+	options map[string][]string
+}
+
+// Parses "uci show" output into its sections, in order.
+func parseUCIShow(src string) (sections []*uciSection, err error) {
+	byName := make(map[string]*uciSection)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("Parse error %q", line)
+			return
+		}
+		path := strings.Split(kv[0], ".")
+		var values []string
+		values, err = parseUCIValues(kv[1])
+		if err != nil {
+			return
+		}
+		switch len(path) {
+		case 2:
+			// config.section=type
+			if len(values) != 1 {
+				err = fmt.Errorf("Parse error %q", line)
+				return
+			}
+			section := &uciSection{path[1], values[0], make(map[string][]string)}
+			sections = append(sections, section)
+			byName[section.name] = section
+		case 3:
+			// config.section.option='value' ...
+			section, ok := byName[path[1]]
+			if !ok {
+				err = fmt.Errorf("Option of unknown section %q", line)
+				return
+			}
+			section.options[path[2]] = values
+		default:
+			err = fmt.Errorf("Parse error %q", line)
+			return
+		}
+	}
+	return
+}
+
+// Parses a uci value, which is a list of words, each in single quotes unless
+// it is simple. A single quote inside a word ends the quoting, is escaped
+// with a backslash, and starts the quoting again.
+func parseUCIValues(src string) (values []string, err error) {
+	var value strings.Builder
+	inValue, quoted := false, false
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+			inValue = true
+		case c == '\\' && !quoted && i+1 < len(src):
+			i++
+			value.WriteByte(src[i])
+			inValue = true
+		case c == ' ' && !quoted:
+			if inValue {
+				values = append(values, value.String())
+				value.Reset()
+				inValue = false
+			}
+		default:
+			value.WriteByte(c)
+			inValue = true
+		}
+	}
+	if quoted {
+		err = fmt.Errorf("Unterminated quote in %q", src)
+		return
+	}
+	if inValue {
+		values = append(values, value.String())
+	}
+	return
+}
+
+// Returns the section name and entries of the ipset named setName.
+func parseUCIIPSet(src string, setName string) (section string, ips IPs, err error) {
+	sections, err := parseUCIShow(src)
+	if err != nil {
+		return
+	}
+	for _, s := range sections {
+		if s.typ != "ipset" {
+			continue
+		}
+		// fw3 names an ipset after its section, if it has no name option.
+		name := s.name
+		if names := s.options["name"]; len(names) > 0 {
+			name = names[0]
+		}
+		if name != setName {
+			continue
+		}
+		for _, entry := range s.options["entry"] {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				// Ranges, networks and MAC addresses are not managed by
+				// Seattle Snowman.
+				err = fmt.Errorf("Unsupported ipset entry %q", entry)
+				return
+			}
+			ips = append(ips, ip)
+		}
+		section = s.name
+		return
+	}
+	err = fmt.Errorf("ipset %q not found", setName)
+	return
+}
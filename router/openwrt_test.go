@@ -0,0 +1,188 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A fake CommandRunner that emulates uci and the firewall init script on an
+// OpenWrt router with one ipset.
+type fakeUCI struct {
+	section  string
+	setName  string
+	entries  []string // Committed.
+	staged   []string // Changed but not committed, or nil.
+	commands []string
+	failAdd  bool
+	reloads  int
+}
+
+func (f *fakeUCI) Run(name string, args ...string) (stdout string, err error) {
+	command := name + " " + strings.Join(args, " ")
+	f.commands = append(f.commands, command)
+	option := "firewall." + f.section + ".entry="
+	switch {
+	case command == "uci -X show firewall":
+		entries := f.entries
+		if f.staged != nil {
+			entries = f.staged
+		}
+		var quoted []string
+		for _, e := range entries {
+			quoted = append(quoted, "'"+e+"'")
+		}
+		stdout = "firewall.cfg01e63d=defaults\n" +
+			"firewall.cfg01e63d.syn_flood='1'\n" +
+			fmt.Sprintf("firewall.%s=ipset\n", f.section) +
+			fmt.Sprintf("firewall.%s.name='%s'\n", f.section, f.setName) +
+			fmt.Sprintf("firewall.%s.match='src_ip'\n", f.section)
+		if len(quoted) > 0 {
+			stdout += fmt.Sprintf("firewall.%s.entry=%s\n", f.section, strings.Join(quoted, " "))
+		}
+	case name == "uci" && len(args) == 2 && args[0] == "add_list" && strings.HasPrefix(args[1], option):
+		if f.failAdd {
+			err = fmt.Errorf("%s: Invalid argument", command)
+			return
+		}
+		if f.staged == nil {
+			f.staged = append([]string{}, f.entries...)
+		}
+		f.staged = append(f.staged, strings.TrimPrefix(args[1], option))
+	case name == "uci" && len(args) == 2 && args[0] == "del_list" && strings.HasPrefix(args[1], option):
+		if f.staged == nil {
+			f.staged = append([]string{}, f.entries...)
+		}
+		value := strings.TrimPrefix(args[1], option)
+		var kept []string
+		for _, e := range f.staged {
+			if e != value {
+				kept = append(kept, e)
+			}
+		}
+		f.staged = append([]string{}, kept...)
+	case command == "uci commit firewall":
+		if f.staged != nil {
+			f.entries = f.staged
+			f.staged = nil
+		}
+	case command == "uci revert firewall":
+		f.staged = nil
+	case command == "/etc/init.d/firewall reload":
+		f.reloads++
+	default:
+		err = fmt.Errorf("unexpected command %q", command)
+	}
+	return
+}
+
+func TestUCIFirewall(t *testing.T) {
+	fake := &fakeUCI{section: "seattlesnowman", setName: "SEATTLESNOWMAN_DROP",
+		entries: []string{"192.168.1.201", "192.168.1.202"}}
+	f := NewUCIFirewall(fake)
+	ips, err := f.GetAddressGroup("SEATTLESNOWMAN_DROP")
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), fake.entries) {
+		t.Errorf("GetAddressGroup() = %v, %v", ips, err)
+	}
+	err = f.SetAddressGroup("SEATTLESNOWMAN_DROP",
+		IPs{net.ParseIP("192.168.1.202"), net.ParseIP("192.168.1.203")})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	expected := []string{"192.168.1.202", "192.168.1.203"}
+	if !reflect.DeepEqual(fake.entries, expected) || fake.reloads != 1 {
+		t.Errorf("After SetAddressGroup(), entries = %v and reloads = %d, expected %v and 1",
+			fake.entries, fake.reloads, expected)
+	}
+
+	// Nothing to do, so nothing is committed.
+	fake.commands = nil
+	err = f.SetAddressGroup("SEATTLESNOWMAN_DROP",
+		IPs{net.ParseIP("192.168.1.203"), net.ParseIP("192.168.1.202")})
+	if err != nil || len(fake.commands) != 1 {
+		t.Errorf("SetAddressGroup() without changes = %v, ran %v", err, fake.commands)
+	}
+
+	_, err = f.GetAddressGroup("OTHER")
+	if err == nil {
+		t.Errorf("GetAddressGroup() of a missing ipset succeeded")
+	}
+}
+
+func TestUCIFirewallRevertsOnFailure(t *testing.T) {
+	fake := &fakeUCI{section: "cfg0ab2cd", setName: "SEATTLESNOWMAN_DROP",
+		entries: []string{"192.168.1.201"}}
+	f := NewUCIFirewall(fake)
+	fake.failAdd = true
+	err := f.SetAddressGroup("SEATTLESNOWMAN_DROP", IPs{net.ParseIP("192.168.1.202")})
+	if err == nil {
+		t.Errorf("SetAddressGroup() succeeded although uci add_list failed")
+	}
+	if fake.staged != nil || !reflect.DeepEqual(fake.entries, []string{"192.168.1.201"}) || fake.reloads != 0 {
+		t.Errorf("After a failure, staged = %v, entries = %v, reloads = %d",
+			fake.staged, fake.entries, fake.reloads)
+	}
+}
+
+// parseUCIValues test case
+type puvtc struct {
+	src      string
+	expected []string
+	err      bool
+}
+
+var parseUCIValuesTestCases = []puvtc{
+	puvtc{"ipset", []string{"ipset"}, false},
+	puvtc{"'1'", []string{"1"}, false},
+	puvtc{"'192.168.1.201' '192.168.1.202'", []string{"192.168.1.201", "192.168.1.202"}, false},
+	puvtc{`'Kid'\''s devices'`, []string{"Kid's devices"}, false},
+	puvtc{"''", []string{""}, false},
+	puvtc{"'unterminated", nil, true},
+}
+
+func TestParseUCIValues(t *testing.T) {
+	for i, tc := range parseUCIValuesTestCases {
+		values, err := parseUCIValues(tc.src)
+		if (err != nil) != tc.err || !reflect.DeepEqual(values, tc.expected) {
+			t.Errorf("case %d: parseUCIValues(%q) = %q, %v, expected %q", i, tc.src, values, err, tc.expected)
+		}
+	}
+}
+
+func TestParseUCIIPSet(t *testing.T) {
+	src := "firewall.cfg01e63d=defaults\n" +
+		"firewall.kids=ipset\n" +
+		"firewall.kids.match='src_ip'\n" +
+		"firewall.kids.entry='192.168.1.201'\n" +
+		"firewall.cfg0ab2cd=ipset\n" +
+		"firewall.cfg0ab2cd.name='GUESTS'\n" +
+		"firewall.cfg0ab2cd.entry='192.168.2.0/24'\n"
+	// An ipset without a name option is named after its section.
+	section, ips, err := parseUCIIPSet(src, "kids")
+	if err != nil || section != "kids" || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.168.1.201")) {
+		t.Errorf("parseUCIIPSet(kids) = %q, %v, %v", section, ips, err)
+	}
+	_, _, err = parseUCIIPSet(src, "GUESTS")
+	if err == nil {
+		t.Errorf("parseUCIIPSet() of a network succeeded")
+	}
+	_, _, err = parseUCIIPSet("firewall.kids.entry='192.168.1.201'\n", "kids")
+	if err == nil {
+		t.Errorf("parseUCIIPSet() of an option without a section succeeded")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	actual := shellQuote("{ 192.168.1.201, 192.168.1.202 }")
+	if actual != "'{ 192.168.1.201, 192.168.1.202 }'" {
+		t.Errorf("shellQuote() = %s", actual)
+	}
+	actual = shellQuote("Kid's")
+	if actual != `'Kid'\''s'` {
+		t.Errorf("shellQuote() = %s", actual)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// An OPNsense router, which keeps the address group in a firewall alias of
+// type Host(s). It uses the OPNsense API, logging in with an API key and
+// secret.
+type opnsenseFirewall struct {
+	api *restAPI
+}
+
+func NewOPNsenseFirewall(config RESTConfig) (firewall Firewall, err error) {
+	api, err := newRESTAPI(config, func(r *http.Request) {
+		r.SetBasicAuth(config.APIKey, config.APISecret)
+	})
+	if err != nil {
+		return
+	}
+	firewall = &opnsenseFirewall{api}
+	return
+}
+
+/*
+  An example "GET /api/firewall/alias/getItem/{uuid}" result (abridged)
+
+  {"alias": {"enabled": "1", "name": "SEATTLESNOWMAN_DROP",
+    "type": {"host": {"value": "Host(s)", "selected": 1},
+             "network": {"value": "Network(s)", "selected": 0}},
+    "content": {"192.168.1.201": {"value": "192.168.1.201", "selected": 1},
+                "192.168.1.202": {"value": "192.168.1.202", "selected": 1}},
+    "description": "Kids devices"}}
+*/
+
+// An option of an OPNsense field, which lists every choice.
+type opnsenseOption struct {
+	Value    string
+	Selected int
+}
+
+type opnsenseAlias struct {
+	Alias struct {
+		Name string
+		// An object of options, or an empty array if there are none.
+		Content json.RawMessage
+	}
+}
+
+// Returns the alias's UUID.
+func (f *opnsenseFirewall) aliasUUID(groupName string) (uuid string, err error) {
+	// Answers {"uuid": "..."}, or [] if there is no such alias.
+	var result json.RawMessage
+	err = f.api.do("GET", "/api/firewall/alias/getAliasUUID/"+url.PathEscape(groupName), nil, &result)
+	if err != nil {
+		return
+	}
+	var found struct{ UUID string }
+	if json.Unmarshal(result, &found) != nil || found.UUID == "" {
+		err = fmt.Errorf("OPNsense alias %q not found", groupName)
+		return
+	}
+	uuid = found.UUID
+	return
+}
+
+func (f *opnsenseFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	_, ips, err = f.getAlias(groupName)
+	return
+}
+
+// Returns the alias's UUID and addresses.
+func (f *opnsenseFirewall) getAlias(groupName string) (uuid string, ips IPs, err error) {
+	uuid, err = f.aliasUUID(groupName)
+	if err != nil {
+		return
+	}
+	var alias opnsenseAlias
+	err = f.api.do("GET", "/api/firewall/alias/getItem/"+uuid, nil, &alias)
+	if err != nil {
+		return
+	}
+	ips, err = parseOPNsenseContent(alias.Alias.Content)
+	return
+}
+
+func parseOPNsenseContent(content json.RawMessage) (ips IPs, err error) {
+	var options map[string]opnsenseOption
+	if json.Unmarshal(content, &options) != nil {
+		var empty []interface{}
+		if json.Unmarshal(content, &empty) == nil && len(empty) == 0 {
+			return
+		}
+		err = fmt.Errorf("Could not parse OPNsense alias content %s", content)
+		return
+	}
+	var values []string
+	for _, option := range options {
+		if option.Selected == 1 && option.Value != "" {
+			values = append(values, option.Value)
+		}
+	}
+	// Maps have no order, but the result should.
+	sort.Strings(values)
+	for _, value := range values {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			// Networks, ranges and host names are not managed by Seattle
+			// Snowman.
+			err = fmt.Errorf("Unsupported alias entry %q", value)
+			return
+		}
+		ips = append(ips, ip)
+	}
+	return
+}
+
+func (f *opnsenseFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	uuid, currentIPs, err := f.getAlias(groupName)
+	if err != nil {
+		return
+	}
+	addIPs, deleteIPs := computeDifference(currentIPs, ips)
+	log.Printf("OPNsense: updateAddressGroup(%q, %v, %v)", groupName, addIPs, deleteIPs)
+	if len(addIPs) == 0 && len(deleteIPs) == 0 {
+		// Nothing to do.
+		return
+	}
+	var content []string
+	for _, ip := range currentIPs.RemoveAll(deleteIPs).AddAll(addIPs) {
+		content = append(content, ip.String())
+	}
+	body := map[string]interface{}{
+		"alias": map[string]string{"content": strings.Join(content, "\n")},
+	}
+	var saved struct {
+		Result      string
+		Validations map[string]interface{}
+	}
+	err = f.api.do("POST", "/api/firewall/alias/setItem/"+uuid, body, &saved)
+	if err != nil {
+		return
+	}
+	if saved.Result != "saved" {
+		err = fmt.Errorf("OPNsense did not save alias %q: %s %v", groupName, saved.Result, saved.Validations)
+		return
+	}
+	// The saved alias isn't used until the aliases are reconfigured.
+	var reconfigured struct{ Status string }
+	err = f.api.do("POST", "/api/firewall/alias/reconfigure", map[string]string{}, &reconfigured)
+	if err != nil {
+		return
+	}
+	if strings.ToLower(strings.TrimSpace(reconfigured.Status)) != "ok" {
+		err = fmt.Errorf("OPNsense could not apply alias %q: %q", groupName, reconfigured.Status)
+	}
+	return
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Writes the test server's certificate to a file in dir, for CACertPath.
+func serverCertHelper(t *testing.T, server *httptest.Server, dir string) string {
+	path := filepath.Join(dir, "router.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatalf("ioutil.WriteFile() = %v", err)
+	}
+	return path
+}
+
+// An OPNsense API with one alias. Saved changes only become live when the
+// aliases are reconfigured.
+type fakeOPNsense struct {
+	mutex           sync.Mutex
+	name            string
+	uuid            string
+	content         []string // Saved.
+	live            []string // Applied.
+	failReconfigure bool
+}
+
+func (f *fakeOPNsense) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key, secret, ok := r.BasicAuth()
+	if !ok || key != "key" || secret != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": 401, "message": "Authentication Failed"})
+		return
+	}
+	var result interface{}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/firewall/alias/getAliasUUID/"+f.name:
+		result = map[string]string{"uuid": f.uuid}
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/firewall/alias/getAliasUUID/"):
+		result = []string{}
+	case r.Method == "GET" && r.URL.Path == "/api/firewall/alias/getItem/"+f.uuid:
+		content := make(map[string]interface{})
+		for _, c := range f.content {
+			content[c] = map[string]interface{}{"value": c, "selected": 1}
+		}
+		var contentJSON interface{} = content
+		if len(content) == 0 {
+			contentJSON = []string{}
+		}
+		result = map[string]interface{}{"alias": map[string]interface{}{
+			"enabled": "1", "name": f.name, "content": contentJSON}}
+	case r.Method == "POST" && r.URL.Path == "/api/firewall/alias/setItem/"+f.uuid:
+		var body struct{ Alias struct{ Content string } }
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.content = nil
+		for _, c := range strings.Split(body.Alias.Content, "\n") {
+			if c == "" {
+				continue
+			}
+			if net.ParseIP(c) == nil {
+				result = map[string]interface{}{"result": "failed",
+					"validations": map[string]string{"alias.content": "Entry \"" + c + "\" is not a valid hostname or IP address."}}
+				break
+			}
+			f.content = append(f.content, c)
+		}
+		if result == nil {
+			result = map[string]string{"result": "saved"}
+		}
+	case r.Method == "POST" && r.URL.Path == "/api/firewall/alias/reconfigure":
+		if f.failReconfigure {
+			result = map[string]string{"status": "failed"}
+		} else {
+			f.live = append([]string{}, f.content...)
+			result = map[string]string{"status": "ok"}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeOPNsense) state() (content []string, live []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append(content, f.content...), append(live, f.live...)
+}
+
+func TestOPNsenseFirewall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opnsense")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fake := &fakeOPNsense{name: testGroup, uuid: "4ae3b9a6-6c1c-4e1b-8a5d-2f1f3b7c9e10",
+		content: []string{"192.168.1.202", "192.168.1.201"}}
+	fake.live = fake.content
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	config := RESTConfig{Address: server.URL, APIKey: "key", APISecret: "secret",
+		CACertPath: serverCertHelper(t, server, dir)}
+	f, err := NewOPNsenseFirewall(config)
+	if err != nil {
+		t.Fatalf("NewOPNsenseFirewall() = %v", err)
+	}
+
+	ips, err := f.GetAddressGroup(testGroup)
+	expected := []string{"192.168.1.201", "192.168.1.202"}
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), expected) {
+		t.Errorf("GetAddressGroup() = %v, %v, expected %v", ips, err, expected)
+	}
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.202"), net.ParseIP("192.168.1.203")})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	expected = []string{"192.168.1.202", "192.168.1.203"}
+	if _, live := fake.state(); !reflect.DeepEqual(live, expected) {
+		t.Errorf("After SetAddressGroup(), the live alias is %v, expected %v", live, expected)
+	}
+	err = f.SetAddressGroup(testGroup, nil)
+	if err != nil {
+		t.Errorf("SetAddressGroup(nil) = %v", err)
+	}
+	if ips, err := f.GetAddressGroup(testGroup); err != nil || len(ips) != 0 {
+		t.Errorf("GetAddressGroup() of an empty alias = %v, %v", ips, err)
+	}
+
+	fake.mutex.Lock()
+	fake.failReconfigure = true
+	fake.mutex.Unlock()
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.204")})
+	if err == nil {
+		t.Errorf("SetAddressGroup() succeeded although reconfigure failed")
+	}
+
+	_, err = f.GetAddressGroup("OTHER")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("GetAddressGroup() of a missing alias = %v", err)
+	}
+
+	config.APISecret = "wrong"
+	f, err = NewOPNsenseFirewall(config)
+	if err != nil {
+		t.Fatalf("NewOPNsenseFirewall() = %v", err)
+	}
+	_, err = f.GetAddressGroup(testGroup)
+	if e, ok := err.(*restError); !ok || e.status != http.StatusUnauthorized || e.message != "Authentication Failed" {
+		t.Errorf("GetAddressGroup() with the wrong secret = %v", err)
+	}
+}
+
+func TestOPNsenseUntrustedCertificate(t *testing.T) {
+	fake := &fakeOPNsense{name: testGroup, uuid: "4ae3b9a6-6c1c-4e1b-8a5d-2f1f3b7c9e10"}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	f, err := NewOPNsenseFirewall(RESTConfig{Address: server.URL, APIKey: "key", APISecret: "secret"})
+	if err != nil {
+		t.Fatalf("NewOPNsenseFirewall() = %v", err)
+	}
+	_, err = f.GetAddressGroup(testGroup)
+	if err == nil {
+		t.Errorf("GetAddressGroup() trusted a self-signed certificate")
+	}
+}
+
+// baseURL test case
+type butc struct {
+	address  string
+	expected string
+}
+
+var baseURLTestCases = []butc{
+	butc{"192.168.1.1", "https://192.168.1.1"},
+	butc{"192.168.1.1:8443", "https://192.168.1.1:8443"},
+	butc{"https://router.lan/", "https://router.lan"},
+	butc{"http://127.0.0.1:8080", "http://127.0.0.1:8080"},
+}
+
+func TestRESTBaseURL(t *testing.T) {
+	for i, tc := range baseURLTestCases {
+		actual := RESTConfig{Address: tc.address}.baseURL()
+		if actual != tc.expected {
+			t.Errorf("case %d: baseURL(%q) = %q, expected %q", i, tc.address, actual, tc.expected)
+		}
+	}
+}
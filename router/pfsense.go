@@ -0,0 +1,126 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// A pfSense router, which keeps the address group in a firewall alias of
+// type host. It uses the REST API of the pfSense-pkg-RESTAPI package (v2),
+// logging in with an API key.
+type pfsenseFirewall struct {
+	api *restAPI
+}
+
+func NewPfSenseFirewall(config RESTConfig) (firewall Firewall, err error) {
+	api, err := newRESTAPI(config, func(r *http.Request) {
+		r.Header.Set("X-API-Key", config.APIKey)
+	})
+	if err != nil {
+		return
+	}
+	firewall = &pfsenseFirewall{api}
+	return
+}
+
+/*
+  An example "GET /api/v2/firewall/aliases?name=SEATTLESNOWMAN_DROP" result
+
+  {"code": 200, "status": "ok", "response_id": "SUCCESS", "message": "",
+   "data": [{"id": 3, "name": "SEATTLESNOWMAN_DROP", "type": "host",
+     "descr": "Kids devices", "address": ["192.168.1.201", "192.168.1.202"],
+     "detail": ["", ""]}]}
+*/
+
+type pfsenseAlias struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Address []string `json:"address"`
+	Detail  []string `json:"detail"`
+}
+
+// Returns the alias named groupName.
+func (f *pfsenseFirewall) getAlias(groupName string) (alias pfsenseAlias, err error) {
+	var result struct{ Data []pfsenseAlias }
+	err = f.api.do("GET", "/api/v2/firewall/aliases?name="+url.QueryEscape(groupName), nil, &result)
+	if err != nil {
+		return
+	}
+	for _, a := range result.Data {
+		if a.Name == groupName {
+			alias = a
+			return
+		}
+	}
+	err = fmt.Errorf("pfSense alias %q not found", groupName)
+	return
+}
+
+func (f *pfsenseFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	alias, err := f.getAlias(groupName)
+	if err != nil {
+		return
+	}
+	return parsePfSenseAddresses(alias)
+}
+
+func parsePfSenseAddresses(alias pfsenseAlias) (ips IPs, err error) {
+	for _, address := range alias.Address {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			// Networks, ranges and host names are not managed by Seattle
+			// Snowman.
+			err = fmt.Errorf("Unsupported alias entry %q", address)
+			return
+		}
+		ips = append(ips, ip)
+	}
+	return
+}
+
+func (f *pfsenseFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	alias, err := f.getAlias(groupName)
+	if err != nil {
+		return
+	}
+	currentIPs, err := parsePfSenseAddresses(alias)
+	if err != nil {
+		return
+	}
+	addIPs, deleteIPs := computeDifference(currentIPs, ips)
+	log.Printf("pfSense: updateAddressGroup(%q, %v, %v)", groupName, addIPs, deleteIPs)
+	if len(addIPs) == 0 && len(deleteIPs) == 0 {
+		// Nothing to do.
+		return
+	}
+	// Keep the descriptions of the addresses that stay.
+	details := make(map[string]string)
+	for i, address := range alias.Address {
+		if i < len(alias.Detail) {
+			details[net.ParseIP(address).String()] = alias.Detail[i]
+		}
+	}
+	addresses, detail := []string{}, []string{}
+	for _, ip := range currentIPs.RemoveAll(deleteIPs).AddAll(addIPs) {
+		addresses = append(addresses, ip.String())
+		d, ok := details[ip.String()]
+		if !ok {
+			d = "Seattle Snowman"
+		}
+		detail = append(detail, d)
+	}
+	body := map[string]interface{}{"id": alias.ID, "address": addresses, "detail": detail}
+	err = f.api.do("PATCH", "/api/v2/firewall/alias", body, nil)
+	if err != nil {
+		return
+	}
+	// The changed alias isn't used until the changes are applied.
+	err = f.api.do("POST", "/api/v2/firewall/apply", map[string]string{}, nil)
+	return
+}
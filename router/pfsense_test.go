@@ -0,0 +1,133 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// A pfSense REST API with one alias. Changes only become live when they are
+// applied.
+type fakePfSense struct {
+	mutex     sync.Mutex
+	alias     pfsenseAlias
+	live      []string
+	failApply bool
+}
+
+func (f *fakePfSense) reply(w http.ResponseWriter, code int, message string, data interface{}) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code,
+		"status": http.StatusText(code), "message": message, "data": data})
+}
+
+func (f *fakePfSense) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.Header.Get("X-API-Key") != "key" {
+		f.reply(w, http.StatusUnauthorized, "Authentication failed.", nil)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/v2/firewall/aliases":
+		data := []pfsenseAlias{}
+		if name := r.URL.Query().Get("name"); name == "" || name == f.alias.Name {
+			data = append(data, f.alias)
+		}
+		f.reply(w, http.StatusOK, "", data)
+	case r.Method == "PATCH" && r.URL.Path == "/api/v2/firewall/alias":
+		var body pfsenseAlias
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || body.ID != f.alias.ID {
+			f.reply(w, http.StatusNotFound, "Object with ID does not exist.", nil)
+			return
+		}
+		if len(body.Detail) > len(body.Address) {
+			f.reply(w, http.StatusBadRequest, "Field `detail` must not contain more items than `address`.", nil)
+			return
+		}
+		for _, address := range body.Address {
+			if net.ParseIP(address) == nil {
+				f.reply(w, http.StatusBadRequest, "Field `address` contains an invalid value.", nil)
+				return
+			}
+		}
+		f.alias.Address, f.alias.Detail = body.Address, body.Detail
+		f.reply(w, http.StatusOK, "", f.alias)
+	case r.Method == "POST" && r.URL.Path == "/api/v2/firewall/apply":
+		if f.failApply {
+			f.reply(w, http.StatusInternalServerError, "Failed to apply pending changes.", nil)
+			return
+		}
+		f.live = append([]string{}, f.alias.Address...)
+		f.reply(w, http.StatusOK, "", map[string]bool{"applied": true})
+	default:
+		f.reply(w, http.StatusNotFound, "Endpoint not found.", nil)
+	}
+}
+
+func TestPfSenseFirewall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pfsense")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fake := &fakePfSense{alias: pfsenseAlias{ID: 3, Name: testGroup, Type: "host",
+		Address: []string{"192.168.1.201", "192.168.1.202"}, Detail: []string{"Phone", "Console"}}}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+	config := RESTConfig{Address: server.URL, APIKey: "key",
+		CACertPath: serverCertHelper(t, server, dir)}
+	f, err := NewPfSenseFirewall(config)
+	if err != nil {
+		t.Fatalf("NewPfSenseFirewall() = %v", err)
+	}
+
+	ips, err := f.GetAddressGroup(testGroup)
+	expected := []string{"192.168.1.201", "192.168.1.202"}
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), expected) {
+		t.Errorf("GetAddressGroup() = %v, %v, expected %v", ips, err, expected)
+	}
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.202"), net.ParseIP("192.168.1.203")})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	fake.mutex.Lock()
+	expected = []string{"192.168.1.202", "192.168.1.203"}
+	if !reflect.DeepEqual(fake.live, expected) {
+		t.Errorf("After SetAddressGroup(), the live alias is %v, expected %v", fake.live, expected)
+	}
+	if expectedDetail := []string{"Console", "Seattle Snowman"}; !reflect.DeepEqual(fake.alias.Detail, expectedDetail) {
+		t.Errorf("After SetAddressGroup(), the details are %v, expected %v", fake.alias.Detail, expectedDetail)
+	}
+	fake.failApply = true
+	fake.mutex.Unlock()
+
+	err = f.SetAddressGroup(testGroup, nil)
+	if e, ok := err.(*restError); !ok || e.status != http.StatusInternalServerError {
+		t.Errorf("SetAddressGroup() when apply fails = %v", err)
+	}
+
+	_, err = f.GetAddressGroup("OTHER")
+	if err == nil {
+		t.Errorf("GetAddressGroup() of a missing alias succeeded")
+	}
+
+	config.APIKey = "wrong"
+	f, err = NewPfSenseFirewall(config)
+	if err != nil {
+		t.Fatalf("NewPfSenseFirewall() = %v", err)
+	}
+	_, err = f.GetAddressGroup(testGroup)
+	if e, ok := err.(*restError); !ok || e.status != http.StatusUnauthorized || e.message != "Authentication failed." {
+		t.Errorf("GetAddressGroup() with the wrong key = %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"time"
+)
+
+// How long to wait for a router's web API to answer.
+const restTimeout = 30 * time.Second
+
+// How to reach a router's web API.
+type RESTConfig struct {
+	// The router's host name or IP, with an optional :port, or a URL such as
+	// https://192.168.1.1:8443.
+	Address   string
+	APIKey    string
+	APISecret string // Not used by every router.
+	// For routers that log in with a user name and password instead of a key.
+	User     string
+	Password string
+	// The PEM certificate of the router, or of the CA that signed it. If
+	// empty, the system's CAs are used.
+	CACertPath string
+}
+
+// Returns the https URL of the router, without a trailing slash.
+func (c RESTConfig) baseURL() string {
+	if strings.Contains(c.Address, "://") {
+		return strings.TrimSuffix(c.Address, "/")
+	}
+	return "https://" + c.Address
+}
+
+// A JSON web API.
+type restAPI struct {
+	client  *http.Client
+	baseURL string
+	// Adds credentials to each request.
+	authorize func(r *http.Request)
+}
+
+func newRESTAPI(config RESTConfig, authorize func(r *http.Request)) (api *restAPI, err error) {
+	tlsConfig, err := newTLSConfig(config.CACertPath)
+	if err != nil {
+		return
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// Keeps the session cookies of routers that log in.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return
+	}
+	api = &restAPI{
+		client:    &http.Client{Transport: transport, Jar: jar, Timeout: restTimeout},
+		baseURL:   config.baseURL(),
+		authorize: authorize,
+	}
+	return
+}
+
+// An error response from a web API.
+type restError struct {
+	method  string
+	path    string
+	status  int
+	message string
+}
+
+func (e *restError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.method, e.path, e.status,
+		http.StatusText(e.status), e.message)
+}
+
+// Sends body, if not nil, as JSON, and decodes the JSON response into
+// result, if not nil. Responses other than 2xx are returned as a *restError.
+func (api *restAPI) do(method string, path string, body interface{}, result interface{}) (err error) {
+	var reader io.Reader
+	if body != nil {
+		var data []byte
+		data, err = json.Marshal(body)
+		if err != nil {
+			return
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, api.baseURL+path, reader)
+	if err != nil {
+		return
+	}
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	api.authorize(request)
+	response, err := api.client.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Most APIs explain the error in a "message" field.
+		var explanation struct{ Message string }
+		message := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &explanation) == nil && explanation.Message != "" {
+			message = explanation.Message
+		}
+		err = &restError{method, path, response.StatusCode, message}
+		return
+	}
+	if result != nil {
+		err = json.Unmarshal(data, result)
+		if err != nil {
+			err = fmt.Errorf("%s %s: could not parse response: %v", method, path, err)
+		}
+	}
+	return
+}
@@ -3,15 +3,10 @@
 package router
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"strings"
-	"time"
-
-	"golang.org/x/crypto/ssh"
 )
 
 // A slice of net.IPs that defines set operations.
@@ -85,13 +80,13 @@ type Firewall interface {
 }
 
 type edgeRouterFirewall struct {
-	address string
-	privateKeyPath string
-	client *ssh.Client
+	*sshConnection
 }
 
-func NewEdgeRouterFirewall(address string, privateKeyPath string) Firewall {
-	return &edgeRouterFirewall{address, privateKeyPath, nil}
+// Returns a Firewall that controls an EdgeRouter over SSH. It keeps one SSH
+// connection open, and redials when it fails. Close it to hang up.
+func NewEdgeRouterFirewall(config SSHConfig) Firewall {
+	return &edgeRouterFirewall{newSSHConnection(config)}
 }
 
 func (f *edgeRouterFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
@@ -145,7 +140,10 @@ func (f *edgeRouterFirewall) updateAddressGroup(groupName string, setIPs IPs, de
 		cmd = cmd + fmt.Sprintf("%s delete %s %s\n", wrapper, prefix, ip)
 	}
 	cmd = cmd + fmt.Sprintf("%s commit\n", wrapper)
+	// End the session even if the commit failed, but report the failure.
+	cmd = cmd + "status=$?\n"
 	cmd = cmd + fmt.Sprintf("%s end\n", wrapper)
+	cmd = cmd + "exit $status\n"
 	_, err = f.routerRPC(cmd)
 	if err != nil {
 		return
@@ -153,92 +151,9 @@ func (f *edgeRouterFirewall) updateAddressGroup(groupName string, setIPs IPs, de
 	return
 }
 
-func parsekey(file string) (private ssh.Signer, err error) {
-	privateBytes, err := ioutil.ReadFile(file)
-	if err != nil {
-		return
-	}
-
-	private, err = ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		return
-	}
-	return
-}
-
-func (f *edgeRouterFirewall) ensureClient() (err error) {
-	if f.client != nil {
-		f.client.Close()
-		f.client = nil
-	}
-	pkey, err := parsekey(f.privateKeyPath)
-	if err != nil {
-		log.Printf("Failed to parse key %s", err)
-		return
-	}
-	config := &ssh.ClientConfig{
-		User: "ubnt",
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(pkey),
-		},
-	}
-	f.client, err = ssh.Dial("tcp", f.address, config)
-	return
-}
-
-func (f *edgeRouterFirewall) newSession() (session *ssh.Session, err error) {
-    for tries := uint(0); tries < 6; tries++ {
-		err = f.ensureClient()
-		if err != nil {
-			log.Printf("Could not create ssh client: %v", f.address, err.Error())
-			return
-		}
-
-		// Each ClientConn can support multiple interactive sessions,
-		// represented by a Session.
-		session, err = f.client.NewSession()
-		if err != nil {
-			log.Printf("Failed to create session: " + err.Error())
-			// client might have disconnected. Try again.
-			f.client.Close()
-			f.client = nil
-			time.Sleep((1 << tries) * time.Second)
-		}
-	}
-	return
-}
-
+// Runs the commands with vbash, the EdgeOS shell.
 func (f *edgeRouterFirewall) routerRPC(commands string) (result string, err error) {
-	session, err := f.newSession()
-	if err != nil {
-		log.Printf("Failed to create session: " + err.Error())
-		// client might
-		return
-	}
-
-	defer session.Close()
-
-	// Once a Session is created, you can execute a single command on
-	// the remote side using the Run method.
-
-	var stdoutBuffer bytes.Buffer
-	var stderrBuffer bytes.Buffer
-	session.Stdout = &stdoutBuffer
-	session.Stderr = &stderrBuffer
-	session.Stdin = strings.NewReader(commands)
-	if err = session.Start("/bin/vbash"); err != nil {
-		log.Printf("Failed to start: " + err.Error())
-		return
-	}
-	if err = session.Wait(); err != nil {
-		log.Printf("Failed to finish running: " + err.Error())
-		log.Printf("stdout: %q", stdoutBuffer.String())
-		log.Printf("stderr: %q", stderrBuffer.String())
-		return
-	}
-	result = stdoutBuffer.String()
-	log.Printf("router: sent %q\nreceived %q", commands, result)
-	return
+	return f.run("/bin/vbash", commands)
 }
 
 /*
@@ -0,0 +1,230 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/router/routertest"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const testGroup = "SEATTLESNOWMAN_DROP"
+
+// Starts a fake router, and writes its host key to a known_hosts file in dir.
+func newFakeRouterHelper(t *testing.T, dir string) (fake *routertest.FakeEdgeRouter, config SSHConfig) {
+	fake, err := routertest.NewFakeEdgeRouter("admin", "secret")
+	if err != nil {
+		t.Fatalf("routertest.NewFakeEdgeRouter() = %v", err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(fake.Address)}, fake.HostKey) + "\n"
+	err = ioutil.WriteFile(knownHosts, []byte(line), 0600)
+	if err != nil {
+		t.Fatalf("ioutil.WriteFile() = %v", err)
+	}
+	config = SSHConfig{Address: fake.Address, User: "admin", Password: "secret",
+		KnownHostsPath: knownHosts}
+	return
+}
+
+func ipStrings(ips IPs) (s []string) {
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	sort.Strings(s)
+	return
+}
+
+func groupHelper(t *testing.T, fake *routertest.FakeEdgeRouter) []string {
+	addresses, ok := fake.Group(testGroup)
+	if !ok {
+		t.Fatalf("The router has no %s address group", testGroup)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func TestEdgeRouterFirewall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edgerouter")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fake, config := newFakeRouterHelper(t, dir)
+	defer fake.Close()
+	fake.SetGroup(testGroup, "Kids devices", "192.168.1.201", "192.168.1.202")
+	f := NewEdgeRouterFirewall(config)
+	defer f.(*edgeRouterFirewall).Close()
+
+	ips, err := f.GetAddressGroup(testGroup)
+	expected := []string{"192.168.1.201", "192.168.1.202"}
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), expected) {
+		t.Errorf("GetAddressGroup() = %v, %v, expected %v", ips, err, expected)
+	}
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.201"), net.ParseIP("192.168.1.203")})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	expected = []string{"192.168.1.201", "192.168.1.203"}
+	if actual := groupHelper(t, fake); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("After SetAddressGroup(), the router has %v, expected %v", actual, expected)
+	}
+	err = f.SetAddressGroup(testGroup, nil)
+	if err != nil {
+		t.Errorf("SetAddressGroup(nil) = %v", err)
+	}
+	if actual := groupHelper(t, fake); len(actual) != 0 {
+		t.Errorf("After SetAddressGroup(nil), the router has %v", actual)
+	}
+	if fake.Connections() != 1 {
+		t.Errorf("Made %d connections, expected the first to be reused", fake.Connections())
+	}
+}
+
+func TestEdgeRouterFirewallCommitFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edgerouter")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fake, config := newFakeRouterHelper(t, dir)
+	defer fake.Close()
+	fake.SetGroup(testGroup, "Kids devices", "192.168.1.201")
+	f := NewEdgeRouterFirewall(config)
+	defer f.(*edgeRouterFirewall).Close()
+
+	fake.SetFailCommit(true)
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.202")})
+	if err == nil {
+		t.Errorf("SetAddressGroup() succeeded although the commit failed")
+	}
+	expected := []string{"192.168.1.201"}
+	if actual := groupHelper(t, fake); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("After a failed commit, the router has %v, expected %v", actual, expected)
+	}
+	fake.SetFailCommit(false)
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.202")})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	expected = []string{"192.168.1.202"}
+	if actual := groupHelper(t, fake); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("After the commit, the router has %v, expected %v", actual, expected)
+	}
+}
+
+func TestEdgeRouterFirewallRedials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edgerouter")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fake, config := newFakeRouterHelper(t, dir)
+	defer fake.Close()
+	fake.SetGroup(testGroup, "Kids devices", "192.168.1.201")
+	f := NewEdgeRouterFirewall(config)
+	defer f.(*edgeRouterFirewall).Close()
+
+	_, err = f.GetAddressGroup(testGroup)
+	if err != nil {
+		t.Fatalf("GetAddressGroup() = %v", err)
+	}
+	// As if the router rebooted.
+	fake.DropConnections()
+	ips, err := f.GetAddressGroup(testGroup)
+	if err != nil || len(ips) != 1 {
+		t.Errorf("GetAddressGroup() after the connection dropped = %v, %v", ips, err)
+	}
+	if fake.Connections() != 2 {
+		t.Errorf("Made %d connections, expected 2", fake.Connections())
+	}
+}
+
+func TestEdgeRouterFirewallHalfOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edgerouter")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fake, config := newFakeRouterHelper(t, dir)
+	defer fake.Close()
+	fake.SetGroup(testGroup, "Kids devices", "192.168.1.201")
+	f := NewEdgeRouterFirewall(config)
+	defer f.(*edgeRouterFirewall).Close()
+	f.(*edgeRouterFirewall).keepAliveTimeout = 100 * time.Millisecond
+
+	_, err = f.GetAddressGroup(testGroup)
+	if err != nil {
+		t.Fatalf("GetAddressGroup() = %v", err)
+	}
+	// The keepalive before the next command goes unanswered.
+	fake.SetStallRequests(true)
+	start := time.Now()
+	ips, err := f.GetAddressGroup(testGroup)
+	if err != nil || len(ips) != 1 {
+		t.Errorf("GetAddressGroup() on a half-open connection = %v, %v", ips, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetAddressGroup() on a half-open connection took %v", elapsed)
+	}
+	if fake.Connections() != 2 {
+		t.Errorf("Made %d connections, expected 2", fake.Connections())
+	}
+}
+
+func TestEdgeRouterFirewallLogIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edgerouter")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fake, config := newFakeRouterHelper(t, dir)
+	defer fake.Close()
+	fake.SetGroup(testGroup, "Kids devices")
+
+	keyPath, public := writeKeyHelper(t, dir, "router_key", "swordfish")
+	fake.AuthorizeKey(public)
+	keyConfig := config
+	keyConfig.Password = ""
+	keyConfig.PrivateKeyPath = keyPath
+	keyConfig.Passphrase = "swordfish"
+	f := NewEdgeRouterFirewall(keyConfig)
+	_, err = f.GetAddressGroup(testGroup)
+	if err != nil {
+		t.Errorf("GetAddressGroup() with an encrypted key = %v", err)
+	}
+	f.(*edgeRouterFirewall).Close()
+
+	wrongPassword := config
+	wrongPassword.Password = "guess"
+	_, err = NewEdgeRouterFirewall(wrongPassword).GetAddressGroup(testGroup)
+	if err == nil {
+		t.Errorf("GetAddressGroup() with the wrong password succeeded")
+	}
+
+	wrongUser := config
+	wrongUser.User = ""
+	_, err = NewEdgeRouterFirewall(wrongUser).GetAddressGroup(testGroup)
+	if err == nil {
+		t.Errorf("GetAddressGroup() as %q succeeded", DefaultSSHUser)
+	}
+
+	unknownHost := config
+	unknownHost.KnownHostsPath = filepath.Join(dir, "empty_known_hosts")
+	err = ioutil.WriteFile(unknownHost.KnownHostsPath, nil, 0600)
+	if err != nil {
+		t.Fatalf("ioutil.WriteFile() = %v", err)
+	}
+	_, err = NewEdgeRouterFirewall(unknownHost).GetAddressGroup(testGroup)
+	if err == nil {
+		t.Errorf("GetAddressGroup() of a router with an unknown host key succeeded")
+	}
+}
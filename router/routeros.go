@@ -0,0 +1,366 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRouterOSUser    = "admin" // The RouterOS default.
+	DefaultRouterOSPort    = "8728"
+	DefaultRouterOSTLSPort = "8729"
+)
+
+// How long to wait for a RouterOS router to answer.
+const routerOSTimeout = 30 * time.Second
+
+// How to reach a router's RouterOS API.
+type RouterOSConfig struct {
+	Address  string // Host name or IP, with an optional :port.
+	User     string // Defaults to DefaultRouterOSUser.
+	Password string
+	// Use the api-ssl service, which listens on DefaultRouterOSTLSPort.
+	UseTLS bool
+	// The PEM certificate of the router, or of the CA that signed it. If
+	// empty, the system's CAs are used.
+	CACertPath string
+}
+
+// A MikroTik router, which keeps the address group in a firewall address
+// list, one entry per IP. It talks to the router with the RouterOS API.
+type routerOSFirewall struct {
+	config RouterOSConfig
+	// Guards conn, which is kept open between calls.
+	mutex sync.Mutex
+	conn  *routerOSConn
+}
+
+func NewRouterOSFirewall(config RouterOSConfig) Firewall {
+	return &routerOSFirewall{config: config}
+}
+
+// Closes the API connection, if there is one.
+func (f *routerOSFirewall) Close() (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.conn != nil {
+		err = f.conn.Close()
+		f.conn = nil
+	}
+	return
+}
+
+// An entry of an address list.
+type addressListEntry struct {
+	id string
+	ip net.IP
+}
+
+func (f *routerOSFirewall) GetAddressGroup(groupName string) (ips IPs, err error) {
+	entries, err := f.getEntries(groupName)
+	for _, entry := range entries {
+		ips = append(ips, entry.ip)
+	}
+	return
+}
+
+func (f *routerOSFirewall) getEntries(groupName string) (entries []addressListEntry, err error) {
+	replies, err := f.call("/ip/firewall/address-list/print",
+		"?list="+groupName, "=.proplist=.id,address")
+	if err != nil {
+		return
+	}
+	for _, reply := range replies {
+		ip := net.ParseIP(reply["address"])
+		if ip == nil {
+			// Ranges, networks and host names are not managed by Seattle
+			// Snowman.
+			err = fmt.Errorf("Unsupported address list entry %q", reply["address"])
+			return
+		}
+		entries = append(entries, addressListEntry{reply[".id"], ip})
+	}
+	return
+}
+
+func (f *routerOSFirewall) SetAddressGroup(groupName string, ips IPs) (err error) {
+	entries, err := f.getEntries(groupName)
+	if err != nil {
+		return
+	}
+	var currentIPs IPs
+	for _, entry := range entries {
+		currentIPs = append(currentIPs, entry.ip)
+	}
+	addIPs, deleteIPs := computeDifference(currentIPs, ips)
+	log.Printf("RouterOS: updateAddressGroup(%q, %v, %v)", groupName, addIPs, deleteIPs)
+	for _, ip := range addIPs {
+		_, err = f.call("/ip/firewall/address-list/add",
+			"=list="+groupName, "=address="+ip.String(), "=comment=Seattle Snowman")
+		if err != nil {
+			return
+		}
+	}
+	var ids []string
+	for _, entry := range entries {
+		if deleteIPs.Contains(entry.ip) {
+			ids = append(ids, entry.id)
+		}
+	}
+	if len(ids) > 0 {
+		_, err = f.call("/ip/firewall/address-list/remove", "=.id="+strings.Join(ids, ","))
+	}
+	return
+}
+
+// Runs an API command, connecting first if need be. If the connection was
+// lost since the last call, it connects again and retries once.
+func (f *routerOSFirewall) call(command string, args ...string) (replies []map[string]string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for tries := 0; tries < 2; tries++ {
+		reused := f.conn != nil
+		if !reused {
+			f.conn, err = dialRouterOS(f.config)
+			if err != nil {
+				return
+			}
+		}
+		replies, err = f.conn.call(command, args...)
+		if _, ok := err.(*routerOSTrap); ok || err == nil {
+			return
+		}
+		log.Printf("RouterOS connection to %s failed: %v", f.config.Address, err)
+		f.conn.Close()
+		f.conn = nil
+		if !reused {
+			return
+		}
+	}
+	return
+}
+
+// A RouterOS API connection.
+type routerOSConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// An error that the router reported, as opposed to a broken connection.
+type routerOSTrap struct {
+	command string
+	message string
+}
+
+func (e *routerOSTrap) Error() string {
+	return fmt.Sprintf("RouterOS %s: %s", e.command, e.message)
+}
+
+func routerOSAddress(config RouterOSConfig) string {
+	if _, _, err := net.SplitHostPort(config.Address); err == nil {
+		return config.Address
+	}
+	if config.UseTLS {
+		return net.JoinHostPort(config.Address, DefaultRouterOSTLSPort)
+	}
+	return net.JoinHostPort(config.Address, DefaultRouterOSPort)
+}
+
+// Returns the TLS configuration that trusts caCertPath, or the system's CAs
+// if caCertPath is empty.
+func newTLSConfig(caCertPath string) (config *tls.Config, err error) {
+	config = &tls.Config{}
+	if caCertPath == "" {
+		return
+	}
+	pem, err := ioutil.ReadFile(caCertPath)
+	if err != nil {
+		return
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("No certificates in %s", caCertPath)
+	}
+	return
+}
+
+func dialRouterOS(config RouterOSConfig) (c *routerOSConn, err error) {
+	address := routerOSAddress(config)
+	dialer := &net.Dialer{Timeout: routerOSTimeout}
+	var conn net.Conn
+	if config.UseTLS {
+		var tlsConfig *tls.Config
+		tlsConfig, err = newTLSConfig(config.CACertPath)
+		if err != nil {
+			return
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return
+	}
+	c = &routerOSConn{conn, bufio.NewReader(conn)}
+	user := config.User
+	if user == "" {
+		user = DefaultRouterOSUser
+	}
+	_, err = c.call("/login", "=name="+user, "=password="+config.Password)
+	if err != nil {
+		c.Close()
+		c = nil
+	}
+	return
+}
+
+func (c *routerOSConn) Close() error {
+	return c.conn.Close()
+}
+
+// Sends a command, and returns the attributes of each of its !re replies.
+func (c *routerOSConn) call(command string, args ...string) (replies []map[string]string, err error) {
+	c.conn.SetDeadline(time.Now().Add(routerOSTimeout))
+	err = writeRouterOSSentence(c.conn, append([]string{command}, args...))
+	if err != nil {
+		return
+	}
+	var trap *routerOSTrap
+	for {
+		var sentence []string
+		sentence, err = readRouterOSSentence(c.reader)
+		if err != nil {
+			return
+		}
+		if len(sentence) == 0 {
+			continue
+		}
+		attributes := routerOSAttributes(sentence[1:])
+		switch sentence[0] {
+		case "!re":
+			replies = append(replies, attributes)
+		case "!trap":
+			trap = &routerOSTrap{command, attributes["message"]}
+		case "!empty":
+			// RouterOS 7.18 and later say so when nothing matches. !done follows.
+		case "!fatal":
+			message := strings.Join(sentence[1:], " ")
+			err = fmt.Errorf("RouterOS %s: fatal: %s", command, message)
+			return
+		case "!done":
+			if trap != nil {
+				err = trap
+			}
+			return
+		default:
+			err = fmt.Errorf("RouterOS %s: unexpected reply %q", command, sentence[0])
+			return
+		}
+	}
+}
+
+// Turns "=name=value" words into a map.
+func routerOSAttributes(words []string) map[string]string {
+	attributes := make(map[string]string)
+	for _, word := range words {
+		if !strings.HasPrefix(word, "=") {
+			continue
+		}
+		kv := strings.SplitN(word[1:], "=", 2)
+		if len(kv) == 2 {
+			attributes[kv[0]] = kv[1]
+		} else {
+			attributes[kv[0]] = ""
+		}
+	}
+	return attributes
+}
+
+// Writes the words of a sentence, each preceded by its length, followed by
+// an empty word.
+func writeRouterOSSentence(w io.Writer, words []string) (err error) {
+	var buf []byte
+	for _, word := range words {
+		buf = appendRouterOSLength(buf, len(word))
+		buf = append(buf, word...)
+	}
+	buf = append(buf, 0)
+	_, err = w.Write(buf)
+	return
+}
+
+// Lengths take one to five bytes. The high bits of the first byte say how
+// many.
+func appendRouterOSLength(buf []byte, n int) []byte {
+	switch {
+	case n < 0x80:
+		return append(buf, byte(n))
+	case n < 0x4000:
+		return append(buf, byte(n>>8)|0x80, byte(n))
+	case n < 0x200000:
+		return append(buf, byte(n>>16)|0xC0, byte(n>>8), byte(n))
+	case n < 0x10000000:
+		return append(buf, byte(n>>24)|0xE0, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(buf, 0xF0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func readRouterOSLength(r *bufio.Reader) (n int, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	var extra int
+	switch {
+	case first&0x80 == 0:
+		return int(first), nil
+	case first&0xC0 == 0x80:
+		n, extra = int(first&0x3F), 1
+	case first&0xE0 == 0xC0:
+		n, extra = int(first&0x1F), 2
+	case first&0xF0 == 0xE0:
+		n, extra = int(first&0x0F), 3
+	case first == 0xF0:
+		n, extra = 0, 4
+	default:
+		err = fmt.Errorf("RouterOS: bad length byte 0x%02x", first)
+		return
+	}
+	for i := 0; i < extra; i++ {
+		var b byte
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		n = n<<8 | int(b)
+	}
+	return
+}
+
+// Reads words until the empty word that ends a sentence.
+func readRouterOSSentence(r *bufio.Reader) (words []string, err error) {
+	for {
+		var n int
+		n, err = readRouterOSLength(r)
+		if err != nil || n == 0 {
+			return
+		}
+		word := make([]byte, n)
+		_, err = io.ReadFull(r, word)
+		if err != nil {
+			return
+		}
+		words = append(words, string(word))
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/SeattleSnowman/router/routertest"
+)
+
+func TestRouterOSSentence(t *testing.T) {
+	lengths := []int{0, 1, 0x7F, 0x80, 0x3FFF, 0x4000, 0x1FFFFF, 0x200000}
+	var words []string
+	for _, n := range lengths {
+		if n > 0 {
+			words = append(words, strings.Repeat("x", n))
+		}
+	}
+	var buf bytes.Buffer
+	err := writeRouterOSSentence(&buf, words)
+	if err != nil {
+		t.Fatalf("writeRouterOSSentence() = %v", err)
+	}
+	actual, err := readRouterOSSentence(bufio.NewReader(&buf))
+	if err != nil || !reflect.DeepEqual(actual, words) {
+		t.Errorf("readRouterOSSentence() returned %d words, %v", len(actual), err)
+	}
+	for i, n := range lengths {
+		encoded := appendRouterOSLength(nil, n)
+		decoded, err := readRouterOSLength(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil || decoded != n {
+			t.Errorf("case %d: length %d encoded as %x decoded as %d, %v", i, n, encoded, decoded, err)
+		}
+	}
+}
+
+func routerOSListHelper(fake *routertest.FakeRouterOS) []string {
+	addresses := fake.List(testGroup)
+	sort.Strings(addresses)
+	return addresses
+}
+
+func TestRouterOSFirewall(t *testing.T) {
+	fake, err := routertest.NewFakeRouterOS("admin", "secret")
+	if err != nil {
+		t.Fatalf("routertest.NewFakeRouterOS() = %v", err)
+	}
+	defer fake.Close()
+	fake.SetList(testGroup, "192.168.1.201", "192.168.1.202")
+	fake.SetList("OTHER", "10.0.0.1")
+	f := NewRouterOSFirewall(RouterOSConfig{Address: fake.Address, Password: "secret"})
+	defer f.(*routerOSFirewall).Close()
+
+	ips, err := f.GetAddressGroup(testGroup)
+	expected := []string{"192.168.1.201", "192.168.1.202"}
+	if err != nil || !reflect.DeepEqual(ipStrings(ips), expected) {
+		t.Errorf("GetAddressGroup() = %v, %v, expected %v", ips, err, expected)
+	}
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.201"), net.ParseIP("192.168.1.203")})
+	if err != nil {
+		t.Errorf("SetAddressGroup() = %v", err)
+	}
+	expected = []string{"192.168.1.201", "192.168.1.203"}
+	if actual := routerOSListHelper(fake); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("After SetAddressGroup(), the router has %v, expected %v", actual, expected)
+	}
+	err = f.SetAddressGroup(testGroup, nil)
+	if err != nil {
+		t.Errorf("SetAddressGroup(nil) = %v", err)
+	}
+	if actual := routerOSListHelper(fake); len(actual) != 0 {
+		t.Errorf("After SetAddressGroup(nil), the router has %v", actual)
+	}
+	if other := fake.List("OTHER"); len(other) != 1 {
+		t.Errorf("SetAddressGroup() changed another list to %v", other)
+	}
+
+	// Errors that the router reports leave the connection usable.
+	_, err = f.(*routerOSFirewall).call("/system/reboot")
+	if _, ok := err.(*routerOSTrap); !ok {
+		t.Errorf("call(/system/reboot) = %v, expected a trap", err)
+	}
+	_, err = f.GetAddressGroup(testGroup)
+	if err != nil {
+		t.Errorf("GetAddressGroup() after a trap = %v", err)
+	}
+	if fake.Connections() != 1 {
+		t.Errorf("Made %d connections, expected the first to be reused", fake.Connections())
+	}
+
+	// As if the router rebooted.
+	fake.DropConnections()
+	_, err = f.GetAddressGroup(testGroup)
+	if err != nil {
+		t.Errorf("GetAddressGroup() after the connection dropped = %v", err)
+	}
+	if fake.Connections() != 2 {
+		t.Errorf("Made %d connections, expected 2", fake.Connections())
+	}
+}
+
+func TestRouterOSFirewallEmptyList(t *testing.T) {
+	fake, err := routertest.NewFakeRouterOS("admin", "secret")
+	if err != nil {
+		t.Fatalf("routertest.NewFakeRouterOS() = %v", err)
+	}
+	defer fake.Close()
+	fake.SetSendEmpty(true)
+	f := NewRouterOSFirewall(RouterOSConfig{Address: fake.Address, Password: "secret"})
+	defer f.(*routerOSFirewall).Close()
+
+	ips, err := f.GetAddressGroup(testGroup)
+	if err != nil || len(ips) != 0 {
+		t.Errorf("GetAddressGroup() of an empty list = %v, %v", ips, err)
+	}
+	err = f.SetAddressGroup(testGroup, IPs{net.ParseIP("192.168.1.201")})
+	if err != nil {
+		t.Errorf("SetAddressGroup() of an empty list = %v", err)
+	}
+	expected := []string{"192.168.1.201"}
+	if actual := routerOSListHelper(fake); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("After SetAddressGroup(), the router has %v, expected %v", actual, expected)
+	}
+	err = f.SetAddressGroup(testGroup, nil)
+	if err != nil {
+		t.Errorf("SetAddressGroup(nil) = %v", err)
+	}
+	ips, err = f.GetAddressGroup(testGroup)
+	if err != nil || len(ips) != 0 {
+		t.Errorf("GetAddressGroup() after emptying the list = %v, %v", ips, err)
+	}
+}
+
+func TestRouterOSFirewallLogIn(t *testing.T) {
+	fake, err := routertest.NewFakeRouterOS("snowman", "secret")
+	if err != nil {
+		t.Fatalf("routertest.NewFakeRouterOS() = %v", err)
+	}
+	defer fake.Close()
+	f := NewRouterOSFirewall(RouterOSConfig{Address: fake.Address, User: "snowman", Password: "secret"})
+	_, err = f.GetAddressGroup(testGroup)
+	if err != nil {
+		t.Errorf("GetAddressGroup() = %v", err)
+	}
+	f.(*routerOSFirewall).Close()
+	f = NewRouterOSFirewall(RouterOSConfig{Address: fake.Address, Password: "secret"})
+	_, err = f.GetAddressGroup(testGroup)
+	if err == nil || !strings.Contains(err.Error(), "invalid user name or password") {
+		t.Errorf("GetAddressGroup() as %q = %v", DefaultRouterOSUser, err)
+	}
+}
+
+// routerOSAddress test case
+type roatc struct {
+	address  string
+	useTLS   bool
+	expected string
+}
+
+var routerOSAddressTestCases = []roatc{
+	roatc{"192.168.88.1", false, "192.168.88.1:8728"},
+	roatc{"192.168.88.1", true, "192.168.88.1:8729"},
+	roatc{"192.168.88.1:1234", true, "192.168.88.1:1234"},
+}
+
+func TestRouterOSAddress(t *testing.T) {
+	for i, tc := range routerOSAddressTestCases {
+		actual := routerOSAddress(RouterOSConfig{Address: tc.address, UseTLS: tc.useTLS})
+		if actual != tc.expected {
+			t.Errorf("case %d: routerOSAddress(%q, %v) = %q, expected %q", i, tc.address, tc.useTLS, actual, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+// Package routertest provides a fake EdgeRouter for tests. It runs an SSH
+// server on localhost that understands the vbash commands Seattle Snowman
+// sends.
+package routertest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// An address group in the router's configuration.
+type addressGroup struct {
+	description string
+	addresses   []string
+}
+
+// The router's address groups, by name.
+type groups map[string]*addressGroup
+
+func (g groups) copy() groups {
+	result := make(groups)
+	for name, group := range g {
+		result[name] = &addressGroup{group.description,
+			append([]string(nil), group.addresses...)}
+	}
+	return result
+}
+
+// An EdgeRouter that only knows about firewall address groups.
+type FakeEdgeRouter struct {
+	Address  string        // host:port of the SSH server.
+	HostKey  ssh.PublicKey // For known_hosts.
+	User     string
+	Password string // If empty, only authorized keys can log in.
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+
+	mutex          sync.Mutex
+	authorizedKeys []ssh.PublicKey
+	groups         groups // The active configuration.
+	failCommit     bool
+	stallRequests  bool
+	connections    int
+	conns          map[*ssh.ServerConn]bool
+	closed         bool
+}
+
+// Starts a fake router that lets user log in with password, or with an
+// authorized key.
+func NewFakeEdgeRouter(user string, password string) (r *FakeEdgeRouter, err error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	r = &FakeEdgeRouter{
+		Address:  listener.Addr().String(),
+		HostKey:  signer.PublicKey(),
+		User:     user,
+		Password: password,
+		listener: listener,
+		groups:   make(groups),
+		conns:    make(map[*ssh.ServerConn]bool),
+	}
+	r.config = &ssh.ServerConfig{
+		PasswordCallback:  r.checkPassword,
+		PublicKeyCallback: r.checkKey,
+	}
+	r.config.AddHostKey(signer)
+	r.wg.Add(1)
+	go r.serve()
+	return
+}
+
+// Lets key log in as the router's user.
+func (r *FakeEdgeRouter) AuthorizeKey(key ssh.PublicKey) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.authorizedKeys = append(r.authorizedKeys, key)
+}
+
+// Replaces the address group's description and addresses.
+func (r *FakeEdgeRouter) SetGroup(name string, description string, addresses ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.groups[name] = &addressGroup{description, append([]string(nil), addresses...)}
+}
+
+// Returns the addresses of the address group, in the order they were added.
+func (r *FakeEdgeRouter) Group(name string) (addresses []string, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	group, ok := r.groups[name]
+	if ok {
+		addresses = append(addresses, group.addresses...)
+	}
+	return
+}
+
+// Makes every commit fail, leaving the configuration as it was.
+func (r *FakeEdgeRouter) SetFailCommit(fail bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.failCommit = fail
+}
+
+// Makes the router stop answering keepalives and other global requests, as
+// if the connection were half-open. Sessions still work.
+func (r *FakeEdgeRouter) SetStallRequests(stall bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stallRequests = stall
+}
+
+// Returns the number of SSH connections that have logged in.
+func (r *FakeEdgeRouter) Connections() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.connections
+}
+
+// Hangs up on every client, as a router does when it reboots.
+func (r *FakeEdgeRouter) DropConnections() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+// Stops the server and hangs up on every client.
+func (r *FakeEdgeRouter) Close() (err error) {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	err = r.listener.Close()
+	r.DropConnections()
+	r.wg.Wait()
+	return
+}
+
+func (r *FakeEdgeRouter) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if conn.User() == r.User && r.Password != "" && string(password) == r.Password {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Wrong password for %q", conn.User())
+}
+
+func (r *FakeEdgeRouter) checkKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if conn.User() == r.User {
+		for _, authorized := range r.authorizedKeys {
+			if string(authorized.Marshal()) == string(key.Marshal()) {
+				return nil, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Key is not authorized for %q", conn.User())
+}
+
+func (r *FakeEdgeRouter) serve() {
+	defer r.wg.Done()
+	for {
+		netConn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.wg.Add(1)
+		go r.serveConn(netConn)
+	}
+}
+
+func (r *FakeEdgeRouter) serveConn(netConn net.Conn) {
+	defer r.wg.Done()
+	conn, channels, requests, err := ssh.NewServerConn(netConn, r.config)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	r.connections++
+	r.conns[conn] = true
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.conns, conn)
+		r.mutex.Unlock()
+		conn.Close()
+	}()
+	go r.serveRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		r.wg.Add(1)
+		go r.serveSession(channel, channelRequests)
+	}
+}
+
+// Answers keepalives with a failure, as OpenSSH does, unless they are stalled.
+func (r *FakeEdgeRouter) serveRequests(requests <-chan *ssh.Request) {
+	for request := range requests {
+		r.mutex.Lock()
+		stall := r.stallRequests
+		r.mutex.Unlock()
+		if stall {
+			continue
+		}
+		if request.WantReply {
+			request.Reply(false, nil)
+		}
+	}
+}
+
+// Runs the command of an "exec" request, with the session's stdin as input.
+func (r *FakeEdgeRouter) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer r.wg.Done()
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		var exec struct{ Command string }
+		err := ssh.Unmarshal(request.Payload, &exec)
+		if err != nil {
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, nil)
+		status := 127
+		if exec.Command == "/bin/vbash" {
+			script, err := ioutil.ReadAll(channel)
+			if err == nil {
+				status = newShell(r, channel, channel.Stderr()).run(string(script))
+			}
+		} else {
+			fmt.Fprintf(channel.Stderr(), "%s: command not found\n", exec.Command)
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
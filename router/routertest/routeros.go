@@ -0,0 +1,295 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package routertest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// An entry of an address list.
+type addressListEntry struct {
+	id      string
+	list    string
+	address string
+	comment string
+}
+
+// A MikroTik router that only knows about firewall address lists, reachable
+// with the RouterOS API on localhost.
+type FakeRouterOS struct {
+	Address  string // host:port of the API service.
+	User     string
+	Password string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mutex       sync.Mutex
+	entries     []addressListEntry
+	nextID      int
+	connections int
+	conns       map[net.Conn]bool
+	sendEmpty   bool
+}
+
+// Starts a fake router that lets user log in with password.
+func NewFakeRouterOS(user string, password string) (r *FakeRouterOS, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	r = &FakeRouterOS{
+		Address:  listener.Addr().String(),
+		User:     user,
+		Password: password,
+		listener: listener,
+		nextID:   1,
+		conns:    make(map[net.Conn]bool),
+	}
+	r.wg.Add(1)
+	go r.serve()
+	return
+}
+
+// Replaces the addresses of the address list.
+func (r *FakeRouterOS) SetList(name string, addresses ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var kept []addressListEntry
+	for _, entry := range r.entries {
+		if entry.list != name {
+			kept = append(kept, entry)
+		}
+	}
+	r.entries = kept
+	for _, address := range addresses {
+		r.add(name, address, "")
+	}
+}
+
+// Makes a print that matches nothing reply with !empty before !done, like
+// RouterOS 7.18 and later.
+func (r *FakeRouterOS) SetSendEmpty(sendEmpty bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sendEmpty = sendEmpty
+}
+
+// Returns the addresses of the address list, in the order they were added.
+func (r *FakeRouterOS) List(name string) (addresses []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, entry := range r.entries {
+		if entry.list == name {
+			addresses = append(addresses, entry.address)
+		}
+	}
+	return
+}
+
+// Returns the number of API connections that have been made.
+func (r *FakeRouterOS) Connections() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.connections
+}
+
+// Hangs up on every client, as a router does when it reboots.
+func (r *FakeRouterOS) DropConnections() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+// Stops the server and hangs up on every client.
+func (r *FakeRouterOS) Close() (err error) {
+	err = r.listener.Close()
+	r.DropConnections()
+	r.wg.Wait()
+	return
+}
+
+// Must be called with r.mutex held.
+func (r *FakeRouterOS) add(list string, address string, comment string) (id string) {
+	id = fmt.Sprintf("*%X", r.nextID)
+	r.nextID++
+	r.entries = append(r.entries, addressListEntry{id, list, address, comment})
+	return
+}
+
+func (r *FakeRouterOS) serve() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.mutex.Lock()
+		r.connections++
+		r.conns[conn] = true
+		r.mutex.Unlock()
+		r.wg.Add(1)
+		go r.serveConn(conn)
+	}
+}
+
+func (r *FakeRouterOS) serveConn(conn net.Conn) {
+	defer r.wg.Done()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.conns, conn)
+		r.mutex.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	loggedIn := false
+	for {
+		sentence, err := readSentence(reader)
+		if err != nil {
+			return
+		}
+		if len(sentence) == 0 {
+			continue
+		}
+		command, attributes, queries := sentence[0], make(map[string]string), make(map[string]string)
+		for _, word := range sentence[1:] {
+			if kv := strings.SplitN(word[1:], "=", 2); len(kv) == 2 {
+				switch word[0] {
+				case '=':
+					attributes[kv[0]] = kv[1]
+				case '?':
+					queries[kv[0]] = kv[1]
+				}
+			}
+		}
+		var replies [][]string
+		if command == "/login" {
+			if attributes["name"] != r.User || attributes["password"] != r.Password {
+				replies = trap("invalid user name or password (6)")
+			} else {
+				loggedIn = true
+			}
+		} else if !loggedIn {
+			writeSentence(conn, []string{"!fatal", "not logged in"})
+			return
+		} else {
+			replies = r.run(command, attributes, queries)
+		}
+		for _, reply := range replies {
+			err = writeSentence(conn, reply)
+			if err != nil {
+				return
+			}
+		}
+		err = writeSentence(conn, []string{"!done"})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func trap(message string) [][]string {
+	return [][]string{[]string{"!trap", "=message=" + message}}
+}
+
+// Runs an address list command, and returns the replies before !done.
+func (r *FakeRouterOS) run(command string, attributes map[string]string, queries map[string]string) (replies [][]string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch command {
+	case "/ip/firewall/address-list/print":
+		for _, entry := range r.entries {
+			if list, ok := queries["list"]; ok && entry.list != list {
+				continue
+			}
+			replies = append(replies, []string{"!re", "=.id=" + entry.id,
+				"=list=" + entry.list, "=address=" + entry.address,
+				"=comment=" + entry.comment, "=dynamic=false"})
+		}
+		if len(replies) == 0 && r.sendEmpty {
+			replies = [][]string{[]string{"!empty"}}
+		}
+	case "/ip/firewall/address-list/add":
+		list, address := attributes["list"], attributes["address"]
+		if list == "" || net.ParseIP(address) == nil {
+			return trap("invalid value for argument address")
+		}
+		for _, entry := range r.entries {
+			if entry.list == list && entry.address == address {
+				return trap("failure: already have such entry")
+			}
+		}
+		r.add(list, address, attributes["comment"])
+	case "/ip/firewall/address-list/remove":
+		for _, id := range strings.Split(attributes[".id"], ",") {
+			found := false
+			for i, entry := range r.entries {
+				if entry.id == id {
+					r.entries = append(r.entries[:i], r.entries[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return trap("no such item")
+			}
+		}
+	default:
+		return trap("no such command")
+	}
+	return
+}
+
+func writeSentence(w io.Writer, words []string) (err error) {
+	var buf []byte
+	for _, word := range words {
+		n := len(word)
+		switch {
+		case n < 0x80:
+			buf = append(buf, byte(n))
+		case n < 0x4000:
+			buf = append(buf, byte(n>>8)|0x80, byte(n))
+		default:
+			return fmt.Errorf("Word too long: %d bytes", n)
+		}
+		buf = append(buf, word...)
+	}
+	_, err = w.Write(append(buf, 0))
+	return
+}
+
+func readSentence(r *bufio.Reader) (words []string, err error) {
+	for {
+		var first byte
+		first, err = r.ReadByte()
+		if err != nil || first == 0 {
+			return
+		}
+		n := int(first)
+		if first&0x80 != 0 {
+			if first&0xC0 != 0x80 {
+				err = fmt.Errorf("Unsupported length byte 0x%02x", first)
+				return
+			}
+			var second byte
+			second, err = r.ReadByte()
+			if err != nil {
+				return
+			}
+			n = int(first&0x3F)<<8 | int(second)
+		}
+		word := make([]byte, n)
+		_, err = io.ReadFull(r, word)
+		if err != nil {
+			return
+		}
+		words = append(words, string(word))
+	}
+}
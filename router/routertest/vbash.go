@@ -0,0 +1,245 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package routertest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const wrapper = "/opt/vyatta/sbin/vyatta-cfg-cmd-wrapper"
+
+// Runs scripts one line at a time, like vbash, for the handful of commands
+// that the router package uses.
+type shell struct {
+	router    *FakeEdgeRouter
+	stdout    io.Writer
+	stderr    io.Writer
+	status    int // $?
+	variables map[string]string
+	configure bool   // In configure mode.
+	pending   groups // The vyatta-cfg-cmd-wrapper session, if one has begun.
+}
+
+func newShell(router *FakeEdgeRouter, stdout io.Writer, stderr io.Writer) *shell {
+	return &shell{router: router, stdout: stdout, stderr: stderr,
+		variables: make(map[string]string)}
+}
+
+// Runs the script, and returns its exit status.
+func (s *shell) run(script string) int {
+	for _, line := range strings.Split(script, "\n") {
+		words := s.split(line)
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		if name, value, ok := strings.Cut(words[0], "="); ok && len(words) == 1 {
+			s.variables[name] = value
+			s.status = 0
+			continue
+		}
+		switch words[0] {
+		case "source":
+			s.status = 0
+		case "configure":
+			s.configure = true
+			s.status = 0
+		case "exit":
+			if s.configure && len(words) == 1 {
+				s.configure = false
+				s.status = 0
+				continue
+			}
+			if len(words) > 1 {
+				status, err := strconv.Atoi(words[1])
+				if err != nil {
+					status = 2
+				}
+				s.status = status
+			}
+			return s.status
+		case "show":
+			s.status = s.show(words[1:])
+		case wrapper:
+			s.status = s.wrapper(words[1:])
+		default:
+			fmt.Fprintf(s.stderr, "vbash: %s: command not found\n", words[0])
+			s.status = 127
+		}
+	}
+	return s.status
+}
+
+// Splits a line into words, removing double quotes and expanding variables.
+func (s *shell) split(line string) (words []string) {
+	var word strings.Builder
+	inWord, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inWord = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '$' && i+1 < len(line):
+			end := i + 1
+			if line[end] == '?' {
+				end++
+			} else {
+				for end < len(line) && (line[end] == '_' || isAlphanumeric(line[end])) {
+					end++
+				}
+			}
+			name := line[i+1 : end]
+			if name == "?" {
+				word.WriteString(strconv.Itoa(s.status))
+			} else {
+				word.WriteString(s.variables[name])
+			}
+			inWord = true
+			i = end - 1
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// Returns the name of the address group that words, which follow "set",
+// "delete" or "show", are about, and the words after it.
+func groupPath(words []string) (name string, rest []string, ok bool) {
+	prefix := []string{"firewall", "group", "address-group"}
+	if len(words) <= len(prefix) {
+		return
+	}
+	for i, word := range prefix {
+		if words[i] != word {
+			return
+		}
+	}
+	return words[len(prefix)], words[len(prefix)+1:], true
+}
+
+// "show firewall group address-group NAME", in configure mode.
+func (s *shell) show(words []string) int {
+	name, rest, ok := groupPath(words)
+	if !s.configure || !ok || len(rest) > 0 {
+		fmt.Fprintf(s.stderr, "Invalid command: show [%s]\n", strings.Join(words, " "))
+		return 1
+	}
+	s.router.mutex.Lock()
+	defer s.router.mutex.Unlock()
+	group, ok := s.router.groups[name]
+	if !ok {
+		fmt.Fprintf(s.stdout, "Configuration under specified path is empty\n")
+		return 0
+	}
+	for _, address := range group.addresses {
+		fmt.Fprintf(s.stdout, " address %s\n", address)
+	}
+	if group.description != "" {
+		fmt.Fprintf(s.stdout, " description %q\n", group.description)
+	}
+	return 0
+}
+
+// vyatta-cfg-cmd-wrapper begin, set, delete, commit and end.
+func (s *shell) wrapper(words []string) int {
+	if len(words) == 0 {
+		fmt.Fprintf(s.stderr, "Usage: %s <command>\n", wrapper)
+		return 1
+	}
+	if words[0] == "begin" {
+		s.router.mutex.Lock()
+		s.pending = s.router.groups.copy()
+		s.router.mutex.Unlock()
+		return 0
+	}
+	if s.pending == nil {
+		fmt.Fprintf(s.stderr, "%s: no configuration session\n", words[0])
+		return 1
+	}
+	switch words[0] {
+	case "set", "delete":
+		return s.change(words[0], words[1:])
+	case "commit":
+		s.router.mutex.Lock()
+		defer s.router.mutex.Unlock()
+		if s.router.failCommit {
+			fmt.Fprintf(s.stderr, "Commit failed\n")
+			return 1
+		}
+		s.router.groups = s.pending.copy()
+		return 0
+	case "end":
+		s.pending = nil
+		return 0
+	}
+	fmt.Fprintf(s.stderr, "Unknown command %q\n", words[0])
+	return 1
+}
+
+// set or delete the address or the description of an address group.
+func (s *shell) change(command string, words []string) int {
+	name, rest, ok := groupPath(words)
+	if !ok || len(rest) != 2 {
+		fmt.Fprintf(s.stderr, "Invalid path: [%s]\n", strings.Join(words, " "))
+		return 1
+	}
+	group := s.pending[name]
+	if group == nil {
+		if command == "delete" {
+			fmt.Fprintf(s.stderr, "Nothing to delete\n")
+			return 1
+		}
+		group = &addressGroup{}
+		s.pending[name] = group
+	}
+	value := rest[1]
+	switch rest[0] {
+	case "description":
+		if command == "set" {
+			group.description = value
+		} else {
+			group.description = ""
+		}
+		return 0
+	case "address":
+		if net.ParseIP(value) == nil {
+			fmt.Fprintf(s.stderr, "Invalid address %q\n", value)
+			return 1
+		}
+		for i, address := range group.addresses {
+			if address == value {
+				if command == "delete" {
+					group.addresses = append(group.addresses[:i], group.addresses[i+1:]...)
+				}
+				return 0
+			}
+		}
+		if command == "delete" {
+			fmt.Fprintf(s.stderr, "Nothing to delete\n")
+			return 1
+		}
+		group.addresses = append(group.addresses, value)
+		return 0
+	}
+	fmt.Fprintf(s.stderr, "Invalid path: [%s]\n", strings.Join(words, " "))
+	return 1
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package routertest
+
+import (
+	"bytes"
+	"testing"
+)
+
+// shell test case
+type shtc struct {
+	script   string
+	status   int
+	expected string // stdout
+}
+
+var shellTestCases = []shtc{
+	shtc{"", 0, ""},
+	shtc{"source /opt/vyatta/etc/functions/script-template\nconfigure\n" +
+		"show firewall group address-group \"DROP\"\nexit\nexit\n",
+		0, " address 192.168.1.201\n description \"Kids devices\"\n"},
+	shtc{"configure\nshow firewall group address-group \"OTHER\"\nexit\nexit\n",
+		0, "Configuration under specified path is empty\n"},
+	shtc{"show firewall group address-group \"DROP\"\n", 1, ""},
+	shtc{"rm -rf /\n", 127, ""},
+	shtc{"false=1\nexit $false\n", 1, ""},
+	shtc{wrapper + " set firewall group address-group \"DROP\" address 192.168.1.202\n", 1, ""},
+	shtc{wrapper + " begin\n" +
+		wrapper + " set firewall group address-group \"DROP\" address 192.168.1.300\n" +
+		"exit $?\n", 1, ""},
+	shtc{wrapper + " begin\n" +
+		wrapper + " delete firewall group address-group \"DROP\" address 192.168.1.202\n" +
+		"status=$?\n" +
+		wrapper + " end\n" +
+		"exit $status\n", 1, ""},
+}
+
+func TestShell(t *testing.T) {
+	r := &FakeEdgeRouter{groups: make(groups)}
+	r.SetGroup("DROP", "Kids devices", "192.168.1.201")
+	for i, tc := range shellTestCases {
+		var stdout, stderr bytes.Buffer
+		status := newShell(r, &stdout, &stderr).run(tc.script)
+		if status != tc.status || stdout.String() != tc.expected {
+			t.Errorf("case %d: run(%q) = %d, %q, expected %d, %q (stderr %q)",
+				i, tc.script, status, stdout.String(), tc.status, tc.expected, stderr.String())
+		}
+	}
+}
+
+func TestShellCommit(t *testing.T) {
+	r := &FakeEdgeRouter{groups: make(groups)}
+	r.SetGroup("DROP", "Kids devices", "192.168.1.201")
+	script := wrapper + " begin\n" +
+		wrapper + " set firewall group address-group \"DROP\" address 192.168.1.202\n" +
+		wrapper + " delete firewall group address-group \"DROP\" address 192.168.1.201\n" +
+		wrapper + " commit\n" +
+		"status=$?\n" +
+		wrapper + " end\n" +
+		"exit $status\n"
+
+	r.SetFailCommit(true)
+	var stdout, stderr bytes.Buffer
+	if status := newShell(r, &stdout, &stderr).run(script); status != 1 {
+		t.Errorf("Failed commit exited with %d", status)
+	}
+	if addresses, _ := r.Group("DROP"); len(addresses) != 1 || addresses[0] != "192.168.1.201" {
+		t.Errorf("Failed commit changed the group to %v", addresses)
+	}
+
+	r.SetFailCommit(false)
+	if status := newShell(r, &stdout, &stderr).run(script); status != 0 {
+		t.Errorf("Commit exited with %d: %q", status, stderr.String())
+	}
+	if addresses, _ := r.Group("DROP"); len(addresses) != 1 || addresses[0] != "192.168.1.202" {
+		t.Errorf("Commit changed the group to %v", addresses)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	DefaultSSHUser = "ubnt" // The EdgeOS default.
+	DefaultSSHPort = "22"
+)
+
+// How to reach a router over SSH.
+type SSHConfig struct {
+	Address        string // Host name or IP, with an optional :port.
+	User           string // Defaults to DefaultSSHUser.
+	Password       string // Optional.
+	PrivateKeyPath string // Optional.
+	Passphrase     string // For PrivateKeyPath, if it is encrypted.
+	// Use the keys of the ssh-agent that SSH_AUTH_SOCK points to.
+	UseAgent       bool
+	KnownHostsPath string // Defaults to ~/.ssh/known_hosts.
+	// Trust the router's host key the first time we connect, and add it to
+	// KnownHostsPath.
+	PinHostKey bool
+}
+
+// Returns the address with DefaultSSHPort added if it has no port.
+func sshAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, DefaultSSHPort)
+}
+
+func parsekey(file string, passphrase string) (private ssh.Signer, err error) {
+	privateBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if passphrase != "" {
+		private, err = ssh.ParsePrivateKeyWithPassphrase(privateBytes, []byte(passphrase))
+		return
+	}
+	private, err = ssh.ParsePrivateKey(privateBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		err = fmt.Errorf("Private key %s is encrypted, so it needs a passphrase", file)
+	}
+	return
+}
+
+// Returns the ways to log in that config allows. The returned closer, if not
+// nil, must be closed once the connection is made.
+func authMethods(config SSHConfig) (methods []ssh.AuthMethod, closer func() error, err error) {
+	if config.UseAgent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			err = fmt.Errorf("UseAgent is set, but SSH_AUTH_SOCK is not")
+			return
+		}
+		var conn net.Conn
+		conn, err = net.Dial("unix", socket)
+		if err != nil {
+			err = fmt.Errorf("Could not connect to ssh-agent: %v", err)
+			return
+		}
+		closer = conn.Close
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if config.PrivateKeyPath != "" {
+		var key ssh.Signer
+		key, err = parsekey(config.PrivateKeyPath, config.Passphrase)
+		if err != nil {
+			return
+		}
+		methods = append(methods, ssh.PublicKeys(key))
+	}
+	if config.Password != "" {
+		methods = append(methods, ssh.Password(config.Password))
+	}
+	if len(methods) == 0 {
+		err = fmt.Errorf("No way to log in to %s: set a private key, a password, or UseAgent",
+			config.Address)
+	}
+	return
+}
+
+func dialSSH(config SSHConfig, hostKeys *hostKeyChecker) (client *ssh.Client, err error) {
+	methods, closer, err := authMethods(config)
+	if closer != nil {
+		defer closer()
+	}
+	if err != nil {
+		return
+	}
+	user := config.User
+	if user == "" {
+		user = DefaultSSHUser
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            methods,
+		HostKeyCallback: hostKeys.check,
+	}
+	client, err = ssh.Dial("tcp", sshAddress(config.Address), clientConfig)
+	return
+}
+
+// How often to check that an idle SSH connection to the router still works.
+const keepAliveInterval = 30 * time.Second
+
+// How long to wait for the answer to a keepalive. A half-open connection
+// never answers, and the kernel can take minutes to notice.
+const keepAliveTimeout = 10 * time.Second
+
+// An SSH connection to a router that is kept open between commands, and
+// redialed when it fails.
+type sshConnection struct {
+	config   SSHConfig
+	hostKeys *hostKeyChecker
+	// Guards client.
+	mutex             sync.Mutex
+	client            *ssh.Client
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+}
+
+func newSSHConnection(config SSHConfig) *sshConnection {
+	return &sshConnection{
+		config:            config,
+		hostKeys:          newHostKeyChecker(config.KnownHostsPath, config.PinHostKey),
+		keepAliveInterval: keepAliveInterval,
+		keepAliveTimeout:  keepAliveTimeout,
+	}
+}
+
+// Closes the SSH connection, if there is one.
+func (c *sshConnection) Close() (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.client != nil {
+		err = c.client.Close()
+		c.client = nil
+	}
+	return
+}
+
+// Sends an SSH keepalive request. OpenSSH answers it with a failure, which is
+// fine; only an error means that the connection is gone. If there is no
+// answer within timeout, it closes the client and returns an error.
+func sendKeepAlive(client *ssh.Client, timeout time.Duration) (err error) {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-result:
+	case <-timer.C:
+		// Closing the client also ends the SendRequest.
+		client.Close()
+		err = fmt.Errorf("No answer to a keepalive in %v", timeout)
+	}
+	return
+}
+
+// Returns the open client if it still answers, otherwise dials a new one.
+// Must be called with c.mutex held.
+func (c *sshConnection) ensureClient() (client *ssh.Client, err error) {
+	if c.client != nil {
+		if err = sendKeepAlive(c.client, c.keepAliveTimeout); err == nil {
+			client = c.client
+			return
+		}
+		log.Printf("SSH connection to %s is gone: %v", c.config.Address, err)
+		c.client.Close()
+		c.client = nil
+	}
+	client, err = dialSSH(c.config, c.hostKeys)
+	if err != nil {
+		return
+	}
+	c.client = client
+	go c.keepAlive(client)
+	return
+}
+
+// Pings the router while the client is open, so that idle connections are
+// neither dropped by NAT nor left dead until the next command.
+func (c *sshConnection) keepAlive(client *ssh.Client) {
+	closed := make(chan bool)
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(c.keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if err := sendKeepAlive(client, c.keepAliveTimeout); err != nil {
+				log.Printf("SSH keepalive to %s failed: %v", c.config.Address, err)
+				c.dropClient(client)
+				return
+			}
+		}
+	}
+}
+
+// Closes client, and forgets it if it is still the current one.
+func (c *sshConnection) dropClient(client *ssh.Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	client.Close()
+	if c.client == client {
+		c.client = nil
+	}
+}
+
+// Opens a session on the connection. If that fails, the connection may have
+// just died, so it redials once. The watcher retries later if that fails too.
+func (c *sshConnection) newSession() (session *ssh.Session, err error) {
+	for tries := 0; tries < 2; tries++ {
+		c.mutex.Lock()
+		var client *ssh.Client
+		client, err = c.ensureClient()
+		c.mutex.Unlock()
+		if err != nil {
+			log.Printf("Could not create ssh client %s: %v", c.config.Address, err)
+			return
+		}
+
+		// Each ClientConn can support multiple interactive sessions,
+		// represented by a Session.
+		session, err = client.NewSession()
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to create session: %v", err)
+		// client might have disconnected. Try again.
+		c.dropClient(client)
+	}
+	return
+}
+
+// Runs command on the router, with stdin as its input, and returns its
+// output.
+func (c *sshConnection) run(command string, stdin string) (stdout string, err error) {
+	session, err := c.newSession()
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		return
+	}
+
+	defer session.Close()
+
+	var stdoutBuffer bytes.Buffer
+	var stderrBuffer bytes.Buffer
+	session.Stdout = &stdoutBuffer
+	session.Stderr = &stderrBuffer
+	session.Stdin = strings.NewReader(stdin)
+	if err = session.Start(command); err != nil {
+		log.Printf("Failed to start: %v", err)
+		return
+	}
+	if err = session.Wait(); err != nil {
+		log.Printf("Failed to finish running: %v", err)
+		log.Printf("stdout: %q", stdoutBuffer.String())
+		log.Printf("stderr: %q", stderrBuffer.String())
+		err = fmt.Errorf("%s: %v: %s", command, err, strings.TrimSpace(stderrBuffer.String()))
+		return
+	}
+	stdout = stdoutBuffer.String()
+	log.Printf("router: sent %q\nreceived %q", stdin, stdout)
+	return
+}
+
+// Quotes s for the router's shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Runs commands on the router over the connection. It is a CommandRunner.
+func (c *sshConnection) Run(name string, args ...string) (stdout string, err error) {
+	words := []string{shellQuote(name)}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return c.run(strings.Join(words, " "), "")
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshAddress test case
+type satc struct {
+	address  string
+	expected string
+}
+
+var sshAddressTestCases = []satc{
+	satc{"192.168.1.1", "192.168.1.1:22"},
+	satc{"192.168.1.1:2222", "192.168.1.1:2222"},
+	satc{"router.lan", "router.lan:22"},
+	satc{"router.lan:22", "router.lan:22"},
+	satc{"fe80::1", "[fe80::1]:22"},
+	satc{"[fe80::1]:2222", "[fe80::1]:2222"},
+}
+
+func TestSSHAddress(t *testing.T) {
+	for i, tc := range sshAddressTestCases {
+		actual := sshAddress(tc.address)
+		if actual != tc.expected {
+			t.Errorf("case %d: sshAddress(%q) = %q, expected %q", i, tc.address, actual, tc.expected)
+		}
+	}
+}
+
+func writeKeyHelper(t *testing.T, dir string, name string, passphrase string) (path string, public ssh.PublicKey) {
+	publicKey, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() = %v", err)
+	}
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(private, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatalf("ssh.MarshalPrivateKey() = %v", err)
+	}
+	path = filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatalf("ioutil.WriteFile() = %v", err)
+	}
+	public, err = ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey() = %v", err)
+	}
+	return
+}
+
+func TestParseKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshkey")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	plain, plainPublic := writeKeyHelper(t, dir, "plain", "")
+	encrypted, encryptedPublic := writeKeyHelper(t, dir, "encrypted", "swordfish")
+
+	key, err := parsekey(plain, "")
+	if err != nil || string(key.PublicKey().Marshal()) != string(plainPublic.Marshal()) {
+		t.Errorf("parsekey(plain) = %v, %v", key, err)
+	}
+	key, err = parsekey(encrypted, "swordfish")
+	if err != nil || string(key.PublicKey().Marshal()) != string(encryptedPublic.Marshal()) {
+		t.Errorf("parsekey(encrypted) = %v, %v", key, err)
+	}
+	_, err = parsekey(encrypted, "")
+	if err == nil || !strings.Contains(err.Error(), "passphrase") {
+		t.Errorf("parsekey(encrypted) without a passphrase = %v", err)
+	}
+	_, err = parsekey(encrypted, "wrong")
+	if err == nil {
+		t.Errorf("parsekey(encrypted) with the wrong passphrase succeeded")
+	}
+}
+
+func TestAuthMethods(t *testing.T) {
+	os.Setenv("SSH_AUTH_SOCK", "")
+	methods, _, err := authMethods(SSHConfig{Address: "192.168.1.1"})
+	if err == nil {
+		t.Errorf("authMethods() with no way to log in = %v", methods)
+	}
+	methods, _, err = authMethods(SSHConfig{Address: "192.168.1.1", Password: "ubnt"})
+	if err != nil || len(methods) != 1 {
+		t.Errorf("authMethods() with a password = %v, %v", methods, err)
+	}
+	_, _, err = authMethods(SSHConfig{Address: "192.168.1.1", UseAgent: true})
+	if err == nil {
+		t.Errorf("authMethods() with UseAgent and no SSH_AUTH_SOCK succeeded")
+	}
+}
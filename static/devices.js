@@ -12,6 +12,31 @@ function modifyActiveUntil(ip, delta) {
   post("/modifyActiveUntil", "ip="+ip+"&delta="+delta, refresh);
 }
 
+function addProfile(name) {
+  modifyProfileActiveUntil(name, "1h");
+}
+
+function subProfile(name) {
+  modifyProfileActiveUntil(name, "-1h");
+}
+
+function modifyProfileActiveUntil(name, delta) {
+  post("/modifyProfileActiveUntil",
+    "profile="+encodeURIComponent(name)+"&delta="+delta, refresh);
+}
+
+function startQuota(name) {
+  post("/startQuota", "profile="+encodeURIComponent(name), refresh);
+}
+
+function stopQuota(name) {
+  post("/stopQuota", "profile="+encodeURIComponent(name), refresh);
+}
+
+function answerTimeRequest(id, approve) {
+  post("/answerTimeRequest", "id="+id+"&approve="+approve, refresh);
+}
+
 function refresh() {
   location.reload();
 }
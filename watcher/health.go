@@ -0,0 +1,109 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package watcher
+
+import (
+	"log"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/router"
+)
+
+type RouterState string
+
+const (
+	RouterUnknown     RouterState = "unknown" // Not updated yet.
+	RouterOK          RouterState = "ok"
+	RouterUnreachable RouterState = "unreachable"
+)
+
+// Failed firewall updates are tried again after a delay that starts at
+// minRetryDelay and doubles after each failure, up to maxRetryDelay.
+const (
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// Whether the watcher can reach the router.
+type RouterHealth struct {
+	State               RouterState
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	LastError           string
+	ConsecutiveFailures int
+	NextRetry           time.Time // Zero unless a retry is pending.
+	Reconcile           ReconcileStats
+	Routers             []router.FirewallStatus // Each router, if there are several.
+}
+
+func (w *Watcher) RouterHealth() (health RouterHealth) {
+	w.statsMutex.Lock()
+	defer w.statsMutex.Unlock()
+	health = w.health
+	health.Reconcile = w.reconcileStats
+	if m, ok := w.wi.firewall.(*router.MultiFirewall); ok {
+		health.Routers = m.Status()
+	}
+	return
+}
+
+// Returns how long to wait before trying again after failures failures.
+func retryDelay(failures int) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// Records a failure to talk to the router, and schedules a retry. Only called
+// by the loop.
+func (w *Watcher) routerFailed(err error) {
+	now := w.now()
+	w.statsMutex.Lock()
+	if w.health.State != RouterUnreachable {
+		log.Printf("Router is unreachable: %v", err)
+	}
+	w.health.State = RouterUnreachable
+	w.health.LastFailure = now
+	w.health.LastError = err.Error()
+	w.health.ConsecutiveFailures++
+	delay := retryDelay(w.health.ConsecutiveFailures)
+	w.health.NextRetry = now.Add(delay)
+	w.statsMutex.Unlock()
+
+	w.stopRetryTimer()
+	w.retryTimer = w.wi.clock.NewTimer(delay)
+}
+
+// Records a successful firewall update, which has pushed the whole block
+// list to the router. Only called by the loop.
+func (w *Watcher) routerSucceeded() {
+	w.stopRetryTimer()
+	w.statsMutex.Lock()
+	defer w.statsMutex.Unlock()
+	if w.health.State == RouterUnreachable {
+		log.Printf("Router is back after %d failures", w.health.ConsecutiveFailures)
+	}
+	w.health.State = RouterOK
+	w.health.LastSuccess = w.now()
+	w.health.ConsecutiveFailures = 0
+	w.health.NextRetry = time.Time{}
+}
+
+func (w *Watcher) stopRetryTimer() {
+	if w.retryTimer != nil {
+		w.retryTimer.Stop()
+		w.retryTimer = nil
+	}
+}
+
+func (w *Watcher) retryChannel() <-chan time.Time {
+	if w.retryTimer == nil {
+		return nil
+	}
+	return w.retryTimer.C()
+}
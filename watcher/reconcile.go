@@ -0,0 +1,104 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package watcher
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/router"
+)
+
+// How often the firewall is checked, unless SetReconcileInterval is called.
+const DefaultReconcileInterval = 5 * time.Minute
+
+// How often the firewall's address group has been checked against the block
+// list, and how often it was found to be different.
+type ReconcileStats struct {
+	Checks    int
+	Drifts    int
+	LastCheck time.Time
+	LastDrift time.Time // Zero if there has never been a drift.
+}
+
+// Sets how often the firewall's address group is checked against the block
+// list. Changes made to the address group by anything else, like someone
+// editing it by hand or the router restoring an old configuration, are
+// undone. Zero or less turns checking off. Must be called before Start.
+func (w *Watcher) SetReconcileInterval(interval time.Duration) {
+	w.reconcileInterval = interval
+}
+
+func (w *Watcher) ReconcileStats() ReconcileStats {
+	w.statsMutex.Lock()
+	defer w.statsMutex.Unlock()
+	return w.reconcileStats
+}
+
+// Only called by the loop.
+func (w *Watcher) scheduleReconcile() {
+	w.stopReconcileTimer()
+	if w.reconcileInterval > 0 {
+		w.reconcileTimer = w.wi.clock.NewTimer(w.reconcileInterval)
+	}
+}
+
+func (w *Watcher) stopReconcileTimer() {
+	if w.reconcileTimer != nil {
+		w.reconcileTimer.Stop()
+		w.reconcileTimer = nil
+	}
+}
+
+func (w *Watcher) reconcileChannel() <-chan time.Time {
+	if w.reconcileTimer == nil {
+		return nil
+	}
+	return w.reconcileTimer.C()
+}
+
+// Compares the firewall's address group with the block list, and updates the
+// firewall if they differ. Only called by the loop.
+func (w *Watcher) reconcile() {
+	blocked, _, err := w.wi.getBlockList()
+	if err != nil {
+		log.Printf("reconcile: Error getting block list: %v", err)
+		return
+	}
+	var intended router.IPs
+	for _, deviceIP := range blocked {
+		intended = append(intended, net.IP(deviceIP))
+	}
+	actual, err := w.wi.firewall.GetAddressGroup(w.wi.addressGroup)
+	// Several routers that disagree have drifted, even if one of them is right.
+	disagree := errors.Is(err, router.ErrFirewallsDisagree)
+	if err != nil && !disagree {
+		log.Printf("reconcile: Error reading address group %q: %v", w.wi.addressGroup, err)
+		w.routerFailed(err)
+		return
+	}
+	missing := intended.RemoveAll(actual)
+	extra := actual.RemoveAll(intended)
+	drifted := disagree || len(missing) > 0 || len(extra) > 0
+	now := w.now()
+	w.statsMutex.Lock()
+	w.reconcileStats.Checks++
+	w.reconcileStats.LastCheck = now
+	if drifted {
+		w.reconcileStats.Drifts++
+		w.reconcileStats.LastDrift = now
+	}
+	w.statsMutex.Unlock()
+	if !drifted {
+		return
+	}
+	if disagree {
+		log.Printf("reconcile: Address group %q has drifted: %v", w.wi.addressGroup, err)
+	} else {
+		log.Printf("reconcile: Address group %q has drifted, missing %v, extra %v",
+			w.wi.addressGroup, missing, extra)
+	}
+	w.updateFirewall()
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package watcher
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/jackpal/SeattleSnowman/db"
+	"github.com/jackpal/SeattleSnowman/router"
+)
+
+// What to leave in the address group when Seattle Snowman exits, since
+// nothing will update it afterwards.
+type ShutdownPolicy string
+
+const (
+	// Block every device.
+	ShutdownBlock ShutdownPolicy = "block"
+	// Leave the address group as it is.
+	ShutdownLeave ShutdownPolicy = "leave"
+	// Block the devices that their calendars block now, taking away any time
+	// that was given to them.
+	ShutdownCalendar ShutdownPolicy = "calendar"
+)
+
+const DefaultShutdownPolicy = ShutdownCalendar
+
+// Parses a shutdown policy. The empty string means DefaultShutdownPolicy.
+func ParseShutdownPolicy(s string) (policy ShutdownPolicy, err error) {
+	switch policy = ShutdownPolicy(s); policy {
+	case "":
+		policy = DefaultShutdownPolicy
+	case ShutdownBlock, ShutdownLeave, ShutdownCalendar:
+	default:
+		err = fmt.Errorf("Unknown shutdown policy %q", s)
+	}
+	return
+}
+
+// Stops the loop, like Close, then applies the policy to the address group.
+// Afterwards it closes the firewall, if the firewall is an io.Closer.
+func (w *Watcher) Shutdown(policy ShutdownPolicy) (err error) {
+	err = w.Close()
+	if err != nil {
+		return
+	}
+	if closer, ok := w.wi.firewall.(io.Closer); ok {
+		defer func() {
+			if closeErr := closer.Close(); closeErr != nil {
+				log.Printf("Closing the firewall: %v", closeErr)
+			}
+		}()
+	}
+	var blocked []db.DeviceIP
+	switch policy {
+	case ShutdownLeave:
+		return
+	case ShutdownBlock:
+		var devices []db.Device
+		devices, err = w.db.All()
+		for _, d := range devices {
+			blocked = append(blocked, d.IP)
+		}
+	case ShutdownCalendar:
+		blocked, err = db.GetCalendarBlockList(w.db, w.wi.calendars, w.now())
+	default:
+		err = fmt.Errorf("Unknown shutdown policy %q", policy)
+	}
+	if err != nil {
+		return
+	}
+	var ips router.IPs
+	for _, deviceIP := range blocked {
+		ips = append(ips, net.IP(deviceIP))
+	}
+	log.Printf("Shutdown policy %q, leaving blocklist: %v", policy, ips)
+	err = w.wi.firewall.SetAddressGroup(w.wi.addressGroup, ips)
+	return
+}
@@ -3,10 +3,13 @@
 package watcher
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/jackpal/SeattleSnowman/clock"
 	"github.com/jackpal/SeattleSnowman/db"
 	"github.com/jackpal/SeattleSnowman/router"
 )
@@ -14,14 +17,15 @@ import (
 // Internal implementation of the Watcher.
 type firewallUpdater struct {
 	db           db.DB
-	calendar     db.Calendar
+	calendars    db.Calendars
 	firewall     router.Firewall
 	addressGroup string
 	goodUntil    time.Time
+	clock        clock.Clock
 }
 
 func (f *firewallUpdater) getBlockList() (blocked []db.DeviceIP, goodUntil time.Time, err error) {
-	return db.GetBlockList(f.db, f.calendar, time.Now())
+	return db.GetBlockList(f.db, f.calendars, f.clock.Now())
 }
 
 func (f *firewallUpdater) updateFirewall() (newWakeTime bool, err error) {
@@ -42,31 +46,80 @@ func (f *firewallUpdater) updateFirewall() (newWakeTime bool, err error) {
 	return
 }
 
+// How long time requests wait for an answer, unless SetTimeRequestTimeout is
+// called.
+const DefaultTimeRequestTimeout = time.Hour
+
 type Watcher struct {
 	db       db.DB
 	wi       *firewallUpdater
 	commands chan func(*firewallUpdater)
-	timeout  chan bool
+	// Closed by Close. Commands sent after that are dropped, since a request
+	// handler can outlive the loop.
+	stop chan bool
+	// Closed when the loop exits.
+	done chan bool
+	// Owned by the loop. Fires at wakeTime, which is the firewall's
+	// goodUntil, so the firewall can be updated then.
+	wakeTimer clock.Timer
+	wakeTime  time.Time
+	// Serializes changes that read and then write the database, like quota
+	// sessions and time requests.
+	updateMutex        sync.Mutex
+	timeRequestTimeout time.Duration
+	// Owned by the loop. Fires every reconcileInterval, to check the
+	// firewall for changes made behind our back.
+	reconcileTimer    clock.Timer
+	reconcileInterval time.Duration
+	// Owned by the loop. Fires when a failed firewall update should be
+	// tried again.
+	retryTimer clock.Timer
+	// Protects reconcileStats and health, which are written by the loop.
+	statsMutex     sync.Mutex
+	reconcileStats ReconcileStats
+	health         RouterHealth
 }
 
-func NewWatcher(db db.DB, calendar db.Calendar, firewall router.Firewall,
-	addressGroup string) (w *Watcher) {
+func NewWatcher(db db.DB, calendars db.Calendars, firewall router.Firewall,
+	addressGroup string, clock clock.Clock) (w *Watcher) {
 	return &Watcher{
 		db,
-		&firewallUpdater{db, calendar, firewall, addressGroup, time.Time{}},
+		&firewallUpdater{db, calendars, firewall, addressGroup, time.Time{}, clock},
 		make(chan func(*firewallUpdater), 1),
-		make(chan bool, 1),
+		make(chan bool),
+		nil,
+		nil,
+		time.Time{},
+		sync.Mutex{},
+		DefaultTimeRequestTimeout,
+		nil,
+		DefaultReconcileInterval,
+		nil,
+		sync.Mutex{},
+		ReconcileStats{},
+		RouterHealth{State: RouterUnknown},
 	}
 }
 
+// Sets how long time requests wait for an answer before they expire.
+func (w *Watcher) SetTimeRequestTimeout(timeout time.Duration) {
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+	w.timeRequestTimeout = timeout
+}
+
+func (w *Watcher) now() time.Time {
+	return w.wi.clock.Now()
+}
+
 func (w *Watcher) pingFirewall() {
-	w.commands <- func(wi *firewallUpdater) {
-		oldWakeTime := wi.goodUntil
-		_, err := wi.updateFirewall()
-		if err != nil {
-			log.Printf("Error updating firewall: %v", err)
-		}
-		w.maybeScheduleTimeout(oldWakeTime, w.wi.goodUntil)
+	select {
+	case w.commands <- func(wi *firewallUpdater) {
+		w.updateFirewall()
+	}:
+	case <-w.stop:
+		// The change is saved, and the shutdown policy decides what the
+		// address group is left with.
 	}
 }
 
@@ -79,17 +132,100 @@ func (w *Watcher) pingIfNoError(errIn error) (err error) {
 }
 
 func (w *Watcher) AddDevices(devices []db.Device) (err error) {
+	for _, device := range devices {
+		err = w.wi.calendars.Check(device.Calendar)
+		if err != nil {
+			return
+		}
+	}
 	err = w.pingIfNoError(w.db.AddAll(devices))
 	return
 }
 
 func (w *Watcher) AddDevice(device db.Device) (err error) {
+	err = w.wi.calendars.Check(device.Calendar)
+	if err != nil {
+		return
+	}
 	err = w.pingIfNoError(w.db.Add(device))
 	return
 }
 
+// Adds the profiles that are not already in the database.
+func (w *Watcher) AddProfiles(profiles []db.Profile) (err error) {
+	for _, profile := range profiles {
+		var found bool
+		_, found, err = w.db.FindProfile(profile.Name)
+		if err != nil {
+			return
+		}
+		if !found {
+			err = w.AddProfile(profile)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *Watcher) AddProfile(profile db.Profile) (err error) {
+	err = w.wi.calendars.Check(profile.Calendar)
+	if err != nil {
+		return
+	}
+	err = w.pingIfNoError(w.db.AddProfile(profile))
+	return
+}
+
+func (w *Watcher) ModifyProfileActiveUntil(name string, delta time.Duration) (err error) {
+	err = w.pingIfNoError(w.db.ModifyProfileActiveUntil(name, delta, w.now()))
+	return
+}
+
+func (w *Watcher) SetProfileActiveUntil(name string, activeUntil time.Time) (err error) {
+	err = w.pingIfNoError(w.db.SetProfileActiveUntil(name, activeUntil))
+	return
+}
+
+// Unblock the named profile's devices, spending its quota.
+func (w *Watcher) StartQuotaSession(name string) (err error) {
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+	err = w.pingIfNoError(db.StartQuotaSession(w.db, w.wi.calendars, name, w.now()))
+	return
+}
+
+// Block the named profile's devices again, saving the rest of its quota.
+func (w *Watcher) StopQuotaSession(name string) (err error) {
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+	err = w.pingIfNoError(db.StopQuotaSession(w.db, w.wi.calendars, name, w.now()))
+	return
+}
+
+// Returns the quota status of each profile that has a quota.
+func (w *Watcher) QuotaStatus() (statuses map[string]db.QuotaStatus, err error) {
+	profiles, err := w.db.AllProfiles()
+	if err != nil {
+		return
+	}
+	now := w.now()
+	statuses = make(map[string]db.QuotaStatus)
+	for _, p := range profiles {
+		if !p.HasQuota() {
+			continue
+		}
+		statuses[p.Name], err = db.GetQuotaStatus(w.db, w.wi.calendars, p.Name, now)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (w *Watcher) ModifyActiveUntil(ip db.DeviceIP, delta time.Duration) (err error) {
-	err = w.pingIfNoError(w.db.ModifyActiveUntil(ip, delta, time.Now()))
+	err = w.pingIfNoError(w.db.ModifyActiveUntil(ip, delta, w.now()))
 	return
 }
 
@@ -98,19 +234,111 @@ func (w *Watcher) SetActiveUntil(ip db.DeviceIP, activeUntil time.Time) (err err
 	return
 }
 
-func (w *Watcher) maybeScheduleTimeout(oldWakeTime time.Time, wakeTime time.Time) {
-	if !wakeTime.IsZero() &&
-		(oldWakeTime.IsZero() || wakeTime.Before(oldWakeTime)) {
-		sleepTime := wakeTime.Sub(time.Now())
-		go func() {
-			time.Sleep(sleepTime)
-			w.timeout <- true
-		}()
+// Asks a parent for more time for a device. A device can only have one
+// pending request at a time.
+func (w *Watcher) RequestTime(ip db.DeviceIP, duration time.Duration) (request db.TimeRequest, err error) {
+	if duration <= 0 {
+		err = fmt.Errorf("Requested time %v is not positive", duration)
+		return
+	}
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+	_, found, err := w.db.Find(ip)
+	if err != nil {
+		return
+	}
+	if !found {
+		err = fmt.Errorf("Unknown device %v", ip)
+		return
+	}
+	now := w.now()
+	requests, err := w.timeRequests(now)
+	if err != nil {
+		return
+	}
+	for _, r := range requests {
+		if r.Status == db.TimeRequestPending && r.IP.Equal(ip) {
+			err = fmt.Errorf("Device %v already has a pending request", ip)
+			return
+		}
+	}
+	request = db.NewTimeRequest(ip, duration, now)
+	request.ID, err = w.db.AddTimeRequest(request)
+	return
+}
+
+// Returns the pending requests, and the recently answered ones.
+func (w *Watcher) TimeRequests() (requests []db.TimeRequest, err error) {
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+	return w.timeRequests(w.now())
+}
+
+func (w *Watcher) timeRequests(now time.Time) (requests []db.TimeRequest, err error) {
+	err = db.ExpireTimeRequests(w.db, now, w.timeRequestTimeout)
+	if err != nil {
+		return
+	}
+	requests, err = w.db.AllTimeRequests()
+	return
+}
+
+// Approves or denies a pending time request. Approving it gives the device
+// the requested time.
+func (w *Watcher) AnswerTimeRequest(id int, approve bool) (err error) {
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+	now := w.now()
+	err = db.ExpireTimeRequests(w.db, now, w.timeRequestTimeout)
+	if err != nil {
+		return
+	}
+	_, err = db.AnswerTimeRequest(w.db, id, approve, now)
+	if err != nil || !approve {
+		return
+	}
+	w.pingFirewall()
+	return
+}
+
+// Makes the wake timer fire at the firewall's goodUntil, replacing any timer
+// for an earlier or later time. Only called by the loop.
+func (w *Watcher) scheduleWake() {
+	goodUntil := w.wi.goodUntil
+	if w.wakeTimer != nil && w.wakeTime.Equal(goodUntil) {
+		return
 	}
+	w.stopWakeTimer()
+	if goodUntil.IsZero() {
+		return
+	}
+	w.wakeTime = goodUntil
+	w.wakeTimer = w.wi.clock.NewTimer(goodUntil.Sub(w.wi.clock.Now()))
 }
 
+func (w *Watcher) stopWakeTimer() {
+	if w.wakeTimer != nil {
+		w.wakeTimer.Stop()
+		w.wakeTimer = nil
+		w.wakeTime = time.Time{}
+	}
+}
+
+// Returns the wake timer's channel, or nil, which is never ready, if there is
+// no wake timer.
+func (w *Watcher) wakeChannel() <-chan time.Time {
+	if w.wakeTimer == nil {
+		return nil
+	}
+	return w.wakeTimer.C()
+}
+
+// Stops the loop, and waits for it to finish.
 func (w *Watcher) Close() (err error) {
-	close(w.commands)
+	close(w.stop)
+	if w.done != nil {
+		<-w.done
+	}
 	return
 }
 
@@ -120,7 +348,23 @@ func (w *Watcher) State() (state []db.Device, err error) {
 		return
 	}
 	// To simplify UI, treat all times before now as zero.
-	state = zeroTimesBefore(state, time.Now())
+	state = zeroTimesBefore(state, w.now())
+	return
+}
+
+func (w *Watcher) Profiles() (profiles []db.Profile, err error) {
+	all, err := w.db.AllProfiles()
+	if err != nil {
+		return
+	}
+	// To simplify UI, treat all times before now as zero.
+	now := w.now()
+	for _, p := range all {
+		if !p.ActiveUntil.IsZero() && p.ActiveUntil.Before(now) {
+			p.ActiveUntil = time.Time{}
+		}
+		profiles = append(profiles, p)
+	}
 	return
 }
 
@@ -140,24 +384,45 @@ func (w *Watcher) BlockList() (blockList []db.DeviceIP, goodUntil time.Time, err
 }
 
 func (w *Watcher) Start() (err error) {
+	w.done = make(chan bool)
 	go w.loop()
 	return
 }
 
 func (w *Watcher) loop() {
+	defer close(w.done)
+	defer w.stopWakeTimer()
+	defer w.stopReconcileTimer()
+	defer w.stopRetryTimer()
 	w.updateFirewall()
+	w.scheduleReconcile()
 	for {
+		w.scheduleWake()
 		select {
+		case <-w.stop:
+			return
 		case command := <-w.commands:
 			command(w.wi)
-		case <-w.timeout:
+		case <-w.wakeChannel():
+			w.wakeTimer = nil
+			w.wakeTime = time.Time{}
+			w.updateFirewall()
+		case <-w.reconcileChannel():
+			w.reconcile()
+			w.scheduleReconcile()
+		case <-w.retryChannel():
+			w.retryTimer = nil
 			w.updateFirewall()
 		}
 	}
 }
 
 func (w *Watcher) updateFirewall() {
-	oldWakeTime := w.wi.goodUntil
-	w.wi.updateFirewall()
-	w.maybeScheduleTimeout(oldWakeTime, w.wi.goodUntil)
+	_, err := w.wi.updateFirewall()
+	if err != nil {
+		log.Printf("Error updating firewall: %v", err)
+		w.routerFailed(err)
+		return
+	}
+	w.routerSucceeded()
 }
@@ -0,0 +1,460 @@
+// Copyright (C) 2015 John Howard Palevich. All Rights Reserved.
+
+package watcher
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpal/SeattleSnowman/clock/clocktest"
+	"github.com/jackpal/SeattleSnowman/db"
+	"github.com/jackpal/SeattleSnowman/router"
+)
+
+// A firewall that reports each update on a channel.
+type fakeFirewall struct {
+	updates chan router.IPs
+	mutex   sync.Mutex
+	ips     router.IPs
+	fail    bool // Whether the router is unreachable.
+	// Whether GetAddressGroup says that several routers disagree.
+	disagree bool
+	closed   bool
+}
+
+func (f *fakeFirewall) GetAddressGroup(addressGroup string) (ips router.IPs, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.fail {
+		err = fmt.Errorf("dial tcp: connection refused")
+		return
+	}
+	if f.disagree {
+		err = fmt.Errorf("%w: main has %v, mesh has []", router.ErrFirewallsDisagree, f.ips)
+		return
+	}
+	ips = f.ips
+	return
+}
+
+func (f *fakeFirewall) SetAddressGroup(addressGroup string, ips router.IPs) (err error) {
+	f.mutex.Lock()
+	if f.fail {
+		f.mutex.Unlock()
+		return fmt.Errorf("dial tcp: connection refused")
+	}
+	f.ips = ips
+	f.disagree = false
+	f.mutex.Unlock()
+	f.updates <- ips
+	return
+}
+
+func (f *fakeFirewall) Close() (err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return
+}
+
+func (f *fakeFirewall) setIPs(ips router.IPs) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ips = ips
+}
+
+func (f *fakeFirewall) setFail(fail bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.fail = fail
+}
+
+func waitForUpdate(t *testing.T, f *fakeFirewall) (ips router.IPs) {
+	select {
+	case ips = <-f.updates:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a firewall update")
+	}
+	return
+}
+
+// Waits until the clock's only active timer is the one at when.
+func waitForTimer(t *testing.T, c *clocktest.FakeClock, when time.Time) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		timers := c.ActiveTimers()
+		if len(timers) == 1 && timers[0].Equal(when) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Active timers = %v, expected only %v", timers, when)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestWatcher(t *testing.T, now time.Time) (w *Watcher, c *clocktest.FakeClock, f *fakeFirewall) {
+	calendars, err := db.NewCalendars(&db.CalendarConfig{
+		Location:       "America/Los_Angeles",
+		SchoolDayHours: db.TimeOfDayPeriodsConfig{{StartTime: "4:00PM", EndTime: "8:00PM"}},
+		VacationHours:  db.TimeOfDayPeriodsConfig{{StartTime: "1:00PM", EndTime: "9:00PM"}},
+	}, map[string]db.CalendarConfig{"night": db.CalendarConfig{
+		Location:       "America/Los_Angeles",
+		SchoolDayHours: db.TimeOfDayPeriodsConfig{{StartTime: "6:00PM", EndTime: "11:00PM"}},
+		VacationHours:  db.TimeOfDayPeriodsConfig{{StartTime: "6:00PM", EndTime: "11:00PM"}},
+	}})
+	if err != nil {
+		t.Fatalf("db.NewCalendars() = %v", err)
+	}
+	database := db.NewRAMDB()
+	err = database.Open()
+	if err != nil {
+		t.Fatalf("database.Open() = %v", err)
+	}
+	err = database.Add(db.NewDevice("192.168.1.201", "laptop"))
+	if err != nil {
+		t.Fatalf("database.Add() = %v", err)
+	}
+	c = clocktest.NewFakeClock(now)
+	f = &fakeFirewall{updates: make(chan router.IPs, 10)}
+	w = NewWatcher(database, calendars, f, "DROP", c)
+	// Only TestWatcherReconcile wants reconcile timers.
+	w.SetReconcileInterval(0)
+	return
+}
+
+func testLocation(t *testing.T) *time.Location {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("time.LoadLocation() = %v", err)
+	}
+	return location
+}
+
+func TestWatcherWakeTimer(t *testing.T) {
+	location := testLocation(t)
+	at := func(hour int) time.Time {
+		return time.Date(2015, 3, 3, hour, 0, 0, 0, location) // A Tuesday.
+	}
+	w, c, f := newTestWatcher(t, at(17))
+	err := w.Start()
+	if err != nil {
+		t.Fatalf("w.Start() = %v", err)
+	}
+	if ips := waitForUpdate(t, f); len(ips) != 0 {
+		t.Errorf("at 5PM blocked %v", ips)
+	}
+	waitForTimer(t, c, at(20))
+
+	// Moving the wake time out replaces the timer.
+	ip := db.ParseDeviceIP("192.168.1.201")
+	err = w.SetActiveUntil(ip, at(21))
+	if err != nil {
+		t.Fatalf("w.SetActiveUntil() = %v", err)
+	}
+	waitForUpdate(t, f)
+	waitForTimer(t, c, at(21))
+
+	c.Advance(3 * time.Hour)
+	waitForTimer(t, c, at(21))
+	select {
+	case ips := <-f.updates:
+		t.Errorf("Unexpected update %v at 8PM", ips)
+	default:
+	}
+
+	c.Advance(time.Hour)
+	if ips := waitForUpdate(t, f); len(ips) != 1 || !ips[0].Equal(net.IP(ip)) {
+		t.Errorf("at 9PM blocked %v, expected %v", ips, ip)
+	}
+	// Blocked until 4PM the next day.
+	waitForTimer(t, c, at(16).AddDate(0, 0, 1))
+
+	err = w.Close()
+	if err != nil {
+		t.Errorf("w.Close() = %v", err)
+	}
+	if timers := c.ActiveTimers(); len(timers) != 0 {
+		t.Errorf("After Close() active timers = %v", timers)
+	}
+}
+
+func TestWatcherGrantOnSchoolNight(t *testing.T) {
+	location := testLocation(t)
+	at := func(hour, minute int) time.Time {
+		return time.Date(2015, 3, 3, hour, minute, 0, 0, location) // A Tuesday.
+	}
+	w, c, f := newTestWatcher(t, at(19, 30))
+	err := w.Start()
+	if err != nil {
+		t.Fatalf("w.Start() = %v", err)
+	}
+	defer w.Close()
+	waitForUpdate(t, f)
+
+	// Grant an hour at 7:30PM. Hours end at 8PM, but the grant lasts until
+	// 8:30PM.
+	ip := db.ParseDeviceIP("192.168.1.201")
+	err = w.ModifyActiveUntil(ip, time.Hour)
+	if err != nil {
+		t.Fatalf("w.ModifyActiveUntil() = %v", err)
+	}
+	if ips := waitForUpdate(t, f); len(ips) != 0 {
+		t.Errorf("after grant blocked %v", ips)
+	}
+	state, err := w.State()
+	if err != nil || len(state) != 1 || !state[0].ActiveUntil.Equal(at(20, 30)) {
+		t.Errorf("w.State() = %v, %v, expected ActiveUntil %v", state, err, at(20, 30))
+	}
+
+	c.Set(at(20, 0))
+	waitForTimer(t, c, at(20, 30))
+	c.Set(at(20, 30))
+	if ips := waitForUpdate(t, f); len(ips) != 1 || !ips[0].Equal(net.IP(ip)) {
+		t.Errorf("at 8:30PM blocked %v, expected %v", ips, ip)
+	}
+	// The grant has run out, so it is no longer shown.
+	c.Set(at(20, 31))
+	state, err = w.State()
+	if err != nil || len(state) != 1 || !state[0].ActiveUntil.IsZero() {
+		t.Errorf("w.State() = %v, %v, expected no ActiveUntil", state, err)
+	}
+}
+
+// Shutdown test case
+type stc struct {
+	policy   ShutdownPolicy
+	expected int // Number of blocked devices, or -1 for no update.
+}
+
+var shutdownTestCases = []stc{
+	stc{ShutdownBlock, 3},
+	stc{ShutdownCalendar, 2},
+	stc{ShutdownLeave, -1},
+}
+
+func TestWatcherShutdown(t *testing.T) {
+	location := testLocation(t)
+	// A Tuesday, after the default calendar's hours, but during the night
+	// calendar's.
+	now := time.Date(2015, 3, 3, 20, 30, 0, 0, location)
+	for i, tc := range shutdownTestCases {
+		w, _, f := newTestWatcher(t, now)
+		granted := db.NewDevice("192.168.1.202", "phone")
+		granted.ActiveUntil = now.Add(time.Hour)
+		night := db.NewDevice("192.168.1.203", "console")
+		night.Calendar = "night"
+		err := w.db.AddAll([]db.Device{granted, night})
+		if err != nil {
+			t.Fatalf("w.db.AddAll() = %v", err)
+		}
+		err = w.Start()
+		if err != nil {
+			t.Fatalf("w.Start() = %v", err)
+		}
+		if ips := waitForUpdate(t, f); len(ips) != 1 {
+			t.Errorf("case %d: at 8:30PM blocked %v", i, ips)
+		}
+		err = w.Shutdown(tc.policy)
+		if err != nil {
+			t.Errorf("case %d: w.Shutdown(%q) = %v", i, tc.policy, err)
+			continue
+		}
+		f.mutex.Lock()
+		if !f.closed {
+			t.Errorf("case %d: w.Shutdown(%q) did not close the firewall", i, tc.policy)
+		}
+		f.mutex.Unlock()
+		select {
+		case ips := <-f.updates:
+			if len(ips) != tc.expected {
+				t.Errorf("case %d: w.Shutdown(%q) blocked %v", i, tc.policy, ips)
+			}
+		default:
+			if tc.expected >= 0 {
+				t.Errorf("case %d: w.Shutdown(%q) did not update the firewall", i, tc.policy)
+			}
+		}
+	}
+}
+
+// A request handler that outlives the loop must not panic or hang.
+func TestWatcherChangesAfterClose(t *testing.T) {
+	location := testLocation(t)
+	now := time.Date(2015, 3, 3, 21, 0, 0, 0, location)
+	w, _, f := newTestWatcher(t, now)
+	err := w.Start()
+	if err != nil {
+		t.Fatalf("w.Start() = %v", err)
+	}
+	waitForUpdate(t, f)
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("w.Close() = %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		// More changes than the command channel holds.
+		for i := 0; i < 3; i++ {
+			err := w.AddDevice(db.NewDevice(fmt.Sprintf("192.168.1.%d", 210+i), "late"))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("w.AddDevice() after w.Close() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("w.AddDevice() after w.Close() hung")
+	}
+}
+
+func TestParseShutdownPolicy(t *testing.T) {
+	policy, err := ParseShutdownPolicy("")
+	if err != nil || policy != DefaultShutdownPolicy {
+		t.Errorf("ParseShutdownPolicy(\"\") = %q, %v", policy, err)
+	}
+	policy, err = ParseShutdownPolicy("block")
+	if err != nil || policy != ShutdownBlock {
+		t.Errorf("ParseShutdownPolicy(\"block\") = %q, %v", policy, err)
+	}
+	_, err = ParseShutdownPolicy("explode")
+	if err == nil {
+		t.Errorf("ParseShutdownPolicy(\"explode\") succeeded")
+	}
+}
+
+func TestWatcherReconcile(t *testing.T) {
+	location := testLocation(t)
+	// A Tuesday, after the calendar's hours.
+	now := time.Date(2015, 3, 3, 21, 0, 0, 0, location)
+	w, c, f := newTestWatcher(t, now)
+	w.SetReconcileInterval(time.Minute)
+	err := w.Start()
+	if err != nil {
+		t.Fatalf("w.Start() = %v", err)
+	}
+	defer w.Close()
+	blocked := waitForUpdate(t, f)
+	if len(blocked) != 1 {
+		t.Fatalf("at 9PM blocked %v", blocked)
+	}
+
+	// Nothing has changed.
+	c.Advance(time.Minute)
+	waitForStats(t, w, 1, 0)
+
+	// Someone empties the address group by hand.
+	f.setIPs(nil)
+	c.Advance(time.Minute)
+	if ips := waitForUpdate(t, f); len(ips) != 1 || !ips[0].Equal(blocked[0]) {
+		t.Errorf("after drift blocked %v, expected %v", ips, blocked)
+	}
+	waitForStats(t, w, 2, 1)
+
+	// A second router missed an update.
+	f.mutex.Lock()
+	f.disagree = true
+	f.mutex.Unlock()
+	c.Advance(time.Minute)
+	if ips := waitForUpdate(t, f); len(ips) != 1 || !ips[0].Equal(blocked[0]) {
+		t.Errorf("after disagreement blocked %v, expected %v", ips, blocked)
+	}
+	waitForStats(t, w, 3, 2)
+}
+
+func waitForStats(t *testing.T, w *Watcher, checks int, drifts int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := w.ReconcileStats()
+		if stats.Checks == checks && stats.Drifts == drifts {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("w.ReconcileStats() = %+v, expected %d checks and %d drifts", stats, checks, drifts)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitForHealth(t *testing.T, w *Watcher, state RouterState, failures int) (health RouterHealth) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		health = w.RouterHealth()
+		if health.State == state && health.ConsecutiveFailures == failures {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("w.RouterHealth() = %+v, expected %s with %d failures", health, state, failures)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWatcherRetriesUntilRouterIsBack(t *testing.T) {
+	location := testLocation(t)
+	// A Tuesday, after the calendar's hours.
+	now := time.Date(2015, 3, 3, 21, 0, 0, 0, location)
+	w, c, f := newTestWatcher(t, now)
+	if health := w.RouterHealth(); health.State != RouterUnknown {
+		t.Errorf("Before Start() w.RouterHealth() = %+v", health)
+	}
+	f.setFail(true)
+	err := w.Start()
+	if err != nil {
+		t.Fatalf("w.Start() = %v", err)
+	}
+	defer w.Close()
+	health := waitForHealth(t, w, RouterUnreachable, 1)
+	if !health.NextRetry.Equal(now.Add(minRetryDelay)) || health.LastError == "" {
+		t.Errorf("after one failure w.RouterHealth() = %+v", health)
+	}
+
+	// Retries back off.
+	c.Advance(minRetryDelay)
+	health = waitForHealth(t, w, RouterUnreachable, 2)
+	if !health.NextRetry.Equal(c.Now().Add(2 * minRetryDelay)) {
+		t.Errorf("after two failures w.RouterHealth() = %+v", health)
+	}
+
+	// The router comes back, and gets the whole block list.
+	f.setFail(false)
+	c.Advance(2 * minRetryDelay)
+	if ips := waitForUpdate(t, f); len(ips) != 1 {
+		t.Errorf("after the router came back blocked %v", ips)
+	}
+	health = waitForHealth(t, w, RouterOK, 0)
+	if !health.NextRetry.IsZero() || !health.LastSuccess.Equal(c.Now()) {
+		t.Errorf("after the router came back w.RouterHealth() = %+v", health)
+	}
+}
+
+// retryDelay test case
+type rdtc struct {
+	failures int
+	expected time.Duration
+}
+
+var retryDelayTestCases = []rdtc{
+	rdtc{1, 5 * time.Second},
+	rdtc{2, 10 * time.Second},
+	rdtc{4, 40 * time.Second},
+	rdtc{7, 5 * time.Minute},
+	rdtc{100, 5 * time.Minute},
+}
+
+func TestRetryDelay(t *testing.T) {
+	for i, tc := range retryDelayTestCases {
+		if delay := retryDelay(tc.failures); delay != tc.expected {
+			t.Errorf("case %d: retryDelay(%d) = %v, expected %v", i, tc.failures, delay, tc.expected)
+		}
+	}
+}